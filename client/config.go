@@ -3,7 +3,12 @@ package client
 import (
 	"fmt"
 	"github.com/fmnx/cftun/client/tun/transport/argo"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/metrics"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Tunnel struct {
@@ -12,34 +17,122 @@ type Tunnel struct {
 	Url      string `yaml:"url" json:"url"`
 	Protocol string `yaml:"protocol" json:"protocol"`
 	Timeout  int    `yaml:"timeout" json:"timeout"`
+	AuthKey  string `yaml:"auth-key" json:"auth-key"`
+	// Mode is cftun (default) or cloudflared, which speaks to a stock cloudflared
+	// origin like "cloudflared access tcp" and ignores remote and auth-key.
+	Mode string `yaml:"mode" json:"mode"`
+	// PoolSize keeps websockets ready, with the destination sent in-band once used.
+	PoolSize int32 `yaml:"pool-size" json:"pool-size"`
+	// WarmUp is lazy (default), filling the pool as connections are made, or eager.
+	WarmUp     string `yaml:"warm-up" json:"warm-up"`
+	MaxIdleAge int    `yaml:"max-idle-age" json:"max-idle-age"` // seconds
+	// TLS replaces the client tls settings for this tunnel.
+	TLS *TLS `yaml:"tls" json:"tls"`
+	// Headers are added to the client headers, Access replaces the client one.
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	Access  *Access           `yaml:"access" json:"access"`
 }
 
+// tls returns the tls settings of t, nil for the client ones.
+func (t *Tunnel) tls() *TLS {
+	if t == nil {
+		return nil
+	}
+	return t.TLS
+}
+
+const (
+	TunnelModeCloudflared = "cloudflared"
+
+	TunnelWarmUpEager = "eager"
+
+	defaultProbeInterval = 60
+	defaultMaxIdleAge    = 60
+	defaultPoolMin       = 2
+	defaultPoolMax       = 64
+)
+
 type Config struct {
-	CdnIp     string    `yaml:"cdn-ip" json:"cdn-ip"`
-	CdnPort   int       `yaml:"cdn-port" json:"cdn-port"`
-	PoolSize  int32     `yaml:"pool-size" json:"pool-size"`
-	GlobalUrl string    `yaml:"global-url" json:"global-url"`
-	Scheme    string    `yaml:"scheme" json:"scheme"`
-	Tunnels   []*Tunnel `yaml:"tunnels" json:"tunnels"`
-	Tun       *Tun      `yaml:"tun" json:"tun"`
+	CdnIp string `yaml:"cdn-ip" json:"cdn-ip"`
+	// CdnIps are IPs or CIDRs that are probed and ranked, every connection
+	// dials the best one. cdn-ip is added to them when both are set.
+	CdnIps        []string     `yaml:"cdn-ips" json:"cdn-ips"`
+	ProbeInterval int          `yaml:"probe-interval" json:"probe-interval"` // seconds
+	CdnPort       int          `yaml:"cdn-port" json:"cdn-port"`
+	PoolSize      int32        `yaml:"pool-size" json:"pool-size"`
+	GlobalUrl     string       `yaml:"global-url" json:"global-url"`
+	Scheme        string       `yaml:"scheme" json:"scheme"`
+	AuthKey       string       `yaml:"auth-key" json:"auth-key"`
+	Tunnels       []*Tunnel    `yaml:"tunnels" json:"tunnels"`
+	Tun           *Tun         `yaml:"tun" json:"tun"`
+	Socks         *Socks       `yaml:"socks" json:"socks"`
+	Http          *HttpProxy   `yaml:"http" json:"http"`
+	Mixed         *Socks       `yaml:"mixed" json:"mixed"`
+	Transparent   *Transparent `yaml:"transparent" json:"transparent"`
+
+	// MaxIdleAge closes unused pooled websockets, in seconds.
+	MaxIdleAge int `yaml:"max-idle-age" json:"max-idle-age"`
+	// Keepalive pings the websockets to detect the dead ones.
+	Keepalive *argo.Keepalive `yaml:"keepalive" json:"keepalive"`
+	// PoolMin and PoolMax bound the TUN pool, which follows the dial rate. With
+	// pool-size alone the pool keeps that fixed size.
+	PoolMin int32 `yaml:"pool-min" json:"pool-min"`
+	PoolMax int32 `yaml:"pool-max" json:"pool-max"`
+	TLS     *TLS  `yaml:"tls" json:"tls"`
+	// Headers are sent on every websocket, a value may be env:NAME or file:/path.
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	Access  *Access           `yaml:"access" json:"access"`
+	// Metrics is the listen address of the Prometheus metrics, pool statistics included.
+	Metrics string `yaml:"metrics" json:"metrics"`
+
+	edgesMu sync.Mutex
+	edgeSet map[edgeKey]*argo.Edges
+}
+
+// edgeKey tells apart the handshakes the edges are probed with.
+type edgeKey struct {
+	url, authKey string
+	tls          *TLS
+	headers      string
 }
 
 func (c *Config) Run() {
+	if c.Metrics != "" {
+		go metrics.Serve(c.Metrics)
+	}
+
 	if c.Tun != nil && c.Tun.Enable {
-		params := &argo.Params{
-			Scheme:   c.getScheme(),
-			CdnIP:    c.CdnIp,
-			Url:      c.GlobalUrl,
-			Port:     c.getPort(),
-			PoolSize: c.getPoolSize(),
-		}
+		params := c.argoParams(c.GlobalUrl, c.AuthKey, nil)
+		params.Name = "tun"
+		params.PoolSize = c.getPoolSize()
+		params.MinPoolSize, params.MaxPoolSize = c.getPoolBounds()
 		c.Tun.Run(params)
 	}
 
+	if c.Socks != nil {
+		go c.runSocks(c.Socks)
+	}
+	if c.Http != nil {
+		go c.runHttpProxy(c.Http)
+	}
+	if c.Mixed != nil {
+		go c.runMixed(c.Mixed)
+	}
+	if c.Transparent != nil {
+		go c.runTransparent(c.Transparent)
+	}
+
 	for _, tunnel := range c.Tunnels {
 		if tunnel.Url == "" {
 			tunnel.Url = c.GlobalUrl
 		}
+		if tunnel.AuthKey == "" {
+			tunnel.AuthKey = c.AuthKey
+		}
+		if tunnel.Mode == TunnelModeCloudflared && tunnel.Protocol == "udp" {
+			log.Warnln("Tunnel %s: cloudflared mode only supports tcp.", tunnel.Listen)
+			tunnel.Protocol = "tcp"
+		}
 		switch tunnel.Protocol {
 		case "udp":
 			go UdpListen(c, tunnel)
@@ -52,6 +145,71 @@ func (c *Config) Run() {
 	}
 }
 
+// argoParams connects to url, with the tls and headers of tunnel when it is not nil.
+func (c *Config) argoParams(url, authKey string, tunnel *Tunnel) *argo.Params {
+	return &argo.Params{
+		Scheme:  c.getScheme(),
+		CdnIP:   c.CdnIp,
+		Url:     url,
+		Port:    c.getPort(),
+		AuthKey: authKey,
+		Edges:   c.edges(url, authKey, tunnel),
+
+		MaxIdleAge: c.getMaxIdleAge(),
+		Keepalive:  c.Keepalive,
+		TLSConfig:  c.tlsConfig(tunnel.tls()),
+		Headers:    c.extraHeaders(tunnel),
+	}
+}
+
+// edges returns the CDN IPs ranked by the handshake to url with the tls and
+// headers of tunnel, nil without cdn-ips. Connections with the same handshake
+// share them.
+func (c *Config) edges(url, authKey string, tunnel *Tunnel) *argo.Edges {
+	if len(c.CdnIps) == 0 {
+		return nil
+	}
+	extra := c.extraHeaders(tunnel)
+	key := edgeKey{url: url, authKey: authKey, tls: tunnel.tls(), headers: fmt.Sprint(extra)}
+	c.edgesMu.Lock()
+	defer c.edgesMu.Unlock()
+	if edges, ok := c.edgeSet[key]; ok {
+		return edges
+	}
+
+	addrs := c.CdnIps
+	if c.CdnIp != "" {
+		addrs = append([]string{c.CdnIp}, addrs...)
+	}
+	header := make(http.Header)
+	header.Set("Host", strings.Split(url, "/")[0])
+	header.Set("User-Agent", "DEV")
+	addHeaders(header, extra)
+	// Probes send nothing, keep the server from dialing a default destination.
+	header.Set("Forward-Proto", argo.ProtoInband)
+	if authKey != "" {
+		header.Set("Forward-Key", authKey)
+	}
+	interval := time.Duration(c.ProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultProbeInterval * time.Second
+	}
+	probeUrl := fmt.Sprintf("%s://%s", c.getScheme(), url)
+	edges := argo.NewEdges(addrs, c.getPort(), probeUrl, header, interval, c.tlsConfig(tunnel.tls()))
+	if c.edgeSet == nil {
+		c.edgeSet = make(map[edgeKey]*argo.Edges)
+	}
+	c.edgeSet[key] = edges
+	return edges
+}
+
+func (c *Config) getMaxIdleAge() int {
+	if c.MaxIdleAge == 0 {
+		return defaultMaxIdleAge
+	}
+	return c.MaxIdleAge
+}
+
 func (c *Config) getAddress() string {
 	if strings.Contains(c.CdnIp, ":") && !strings.Contains(c.CdnIp, "[") {
 		return fmt.Sprintf("[%s]:%d", c.CdnIp, c.getPort())
@@ -73,6 +231,21 @@ func (c *Config) getPoolSize() int32 {
 	return c.PoolSize
 }
 
+// getPoolBounds returns zeros for a fixed pool.
+func (c *Config) getPoolBounds() (int32, int32) {
+	if c.PoolSize != 0 && c.PoolMin == 0 && c.PoolMax == 0 {
+		return 0, 0
+	}
+	poolMin, poolMax := c.PoolMin, c.PoolMax
+	if poolMin == 0 {
+		poolMin = defaultPoolMin
+	}
+	if poolMax == 0 {
+		poolMax = max(defaultPoolMax, poolMin)
+	}
+	return min(poolMin, poolMax), poolMax
+}
+
 func (c *Config) getScheme() string {
 	if c.Scheme != "" {
 		return c.Scheme
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Access authenticates to hostnames protected by Cloudflare Access, with a
+// service token or an Access token.
+type Access struct {
+	ClientId     string `yaml:"client-id" json:"client-id"`
+	ClientSecret string `yaml:"client-secret" json:"client-secret"`
+	// Token is an Access JWT, e.g. from "cloudflared access token".
+	Token string `yaml:"token" json:"token"`
+}
+
+// headerValue reads the values written as env:NAME or file:/path.
+func headerValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		buf, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(buf)), nil
+	}
+	return value, nil
+}
+
+func buildHeaders(headers map[string]string, access *Access) (http.Header, error) {
+	header := make(http.Header)
+	for key, value := range headers {
+		v, err := headerValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", key, err)
+		}
+		header.Set(key, v)
+	}
+	if access == nil {
+		return header, nil
+	}
+	if access.ClientId != "" || access.ClientSecret != "" {
+		id, err := headerValue(access.ClientId)
+		if err != nil {
+			return nil, fmt.Errorf("access client-id: %w", err)
+		}
+		secret, err := headerValue(access.ClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("access client-secret: %w", err)
+		}
+		header.Set("CF-Access-Client-Id", id)
+		header.Set("CF-Access-Client-Secret", secret)
+	}
+	if access.Token != "" {
+		token, err := headerValue(access.Token)
+		if err != nil {
+			return nil, fmt.Errorf("access token: %w", err)
+		}
+		// cloudflared sends the header, browsers the cookie, Access takes both.
+		header.Set("Cf-Access-Token", token)
+		cookie := "CF_Authorization=" + token
+		if c := header.Get("Cookie"); c != "" {
+			cookie = c + "; " + cookie
+		}
+		header.Set("Cookie", cookie)
+	}
+	return header, nil
+}
+
+// extraHeaders returns the headers sent on the websockets of tunnel, or of the
+// other inbounds when tunnel is nil. The tunnel headers replace the client ones
+// of the same name, its access block replaces the client one.
+func (c *Config) extraHeaders(tunnel *Tunnel) http.Header {
+	headers := make(map[string]string)
+	for key, value := range c.Headers {
+		headers[http.CanonicalHeaderKey(key)] = value
+	}
+	access := c.Access
+	if tunnel != nil {
+		for key, value := range tunnel.Headers {
+			headers[http.CanonicalHeaderKey(key)] = value
+		}
+		if tunnel.Access != nil {
+			access = tunnel.Access
+		}
+	}
+	header, err := buildHeaders(headers, access)
+	if err != nil {
+		log.Fatalln("Invalid headers: %v", err)
+	}
+	return header
+}
+
+// addHeaders sets every value of extra in header.
+func addHeaders(header, extra http.Header) {
+	for key, values := range extra {
+		header[key] = values
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HttpProxy is an HTTP proxy inbound. CONNECT requests are tunneled to their
+// target, plain http:// requests are forwarded to the origin.
+type HttpProxy struct {
+	Listen   string `yaml:"listen" json:"listen"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	Url      string `yaml:"url" json:"url"`
+	AuthKey  string `yaml:"auth-key" json:"auth-key"`
+	PoolSize int32  `yaml:"pool-size" json:"pool-size"`
+}
+
+func (c *Config) runHttpProxy(h *HttpProxy) {
+	server := c.newProxyServer("http", h.Url, h.AuthKey, h.PoolSize, h.Username, h.Password)
+	server.serve("HTTP proxy", h.Listen, server.serveHTTP)
+}
+
+// runMixed serves SOCKS5 and HTTP proxy clients on the same port.
+func (c *Config) runMixed(m *Socks) {
+	server := c.newProxyServer("mixed", m.Url, m.AuthKey, m.PoolSize, m.Username, m.Password)
+	server.udpTimeout = time.Duration(m.UdpTimeout) * time.Second
+	server.serve("Mixed proxy", m.Listen, func(conn net.Conn, r *bufio.Reader) {
+		version, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		if version[0] == socksVersion {
+			server.serveSocks(conn, r)
+		} else {
+			server.serveHTTP(conn, r)
+		}
+	})
+}
+
+// hopHeaders are only meant for the proxy and are not forwarded.
+var hopHeaders = []string{"Proxy-Authorization", "Proxy-Connection", "Proxy-Authenticate"}
+
+func (s *proxyServer) serveHTTP(conn net.Conn, r *bufio.Reader) {
+	var (
+		remote       net.Conn
+		remoteReader *bufio.Reader
+		target       string
+	)
+	defer func() {
+		if remote != nil {
+			_ = remote.Close()
+		}
+	}()
+
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		if !s.httpAuthorized(req) {
+			writeHTTPError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"cftun\"\r\n")
+			return
+		}
+		handshakeDone(conn)
+
+		if req.Method == http.MethodConnect {
+			s.httpConnect(conn, r, req.Host)
+			return
+		}
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			writeHTTPError(conn, http.StatusBadRequest, "")
+			return
+		}
+
+		// Reuse the stream while the client keeps asking the same origin.
+		address := req.URL.Host
+		if _, _, err = net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(strings.Trim(address, "[]"), "80")
+		}
+		if address != target {
+			if remote != nil {
+				_ = remote.Close()
+			}
+			if remote, err = s.argo.DialAddress("tcp", address, nil); err != nil {
+				log.Warnln("[HTTP] dial %s: %v", address, err)
+				remote = nil
+				writeHTTPError(conn, http.StatusBadGateway, "")
+				return
+			}
+			remoteReader, target = bufio.NewReader(remote), address
+		}
+
+		for _, key := range hopHeaders {
+			req.Header.Del(key)
+		}
+		if err = req.Write(remote); err != nil {
+			writeHTTPError(conn, http.StatusBadGateway, "")
+			return
+		}
+		resp, err := http.ReadResponse(remoteReader, req)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadGateway, "")
+			return
+		}
+		err = resp.Write(conn)
+		_ = resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+func (s *proxyServer) httpConnect(conn net.Conn, r *bufio.Reader, target string) {
+	remote, err := s.argo.DialAddress("tcp", target, nil)
+	if err != nil {
+		log.Warnln("[HTTP] dial %s: %v", target, err)
+		writeHTTPError(conn, http.StatusBadGateway, "")
+		return
+	}
+	defer remote.Close()
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	log.Debugln("[HTTP] %s <-> %s", conn.RemoteAddr(), target)
+	relay(conn, r, remote)
+}
+
+func (s *proxyServer) httpAuthorized(req *http.Request) bool {
+	if s.username == "" {
+		return true
+	}
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+	username, password, _ := strings.Cut(string(decoded), ":")
+	return s.authorized(username, password)
+}
+
+func writeHTTPError(conn net.Conn, status int, header string) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), header)
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"github.com/fmnx/cftun/client/tun/proxy"
+	"github.com/fmnx/cftun/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyHandshakeTimeout bounds the time a client takes to authenticate and
+// send its request.
+const proxyHandshakeTimeout = 10 * time.Second
+
+// proxyServer forwards the requests of a local proxy inbound to the server.
+type proxyServer struct {
+	username   string
+	password   string
+	udpTimeout time.Duration
+	argo       *proxy.Argo
+}
+
+func (c *Config) newProxyServer(name, url, authKey string, poolSize int32, username, password string) *proxyServer {
+	if url == "" {
+		url = c.GlobalUrl
+	}
+	if authKey == "" {
+		authKey = c.AuthKey
+	}
+	params := c.argoParams(url, authKey, nil)
+	params.Name = name
+	params.PoolSize = poolSize
+	return &proxyServer{
+		username: username,
+		password: password,
+		argo:     proxy.NewArgo(params),
+	}
+}
+
+func (s *proxyServer) serve(name, listen string, handle func(conn net.Conn, r *bufio.Reader)) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatalln("Failed to listen on %s: %v", listen, err)
+	}
+	log.Infoln("%s listen on %s", name, listen)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Errorln("%s accept error: %v", name, err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			// Cleared by the handler with handshakeDone once the request is read.
+			_ = conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+			handle(conn, bufio.NewReader(conn))
+		}()
+	}
+}
+
+// handshakeDone lifts the handshake deadline of conn.
+func handshakeDone(conn net.Conn) {
+	_ = conn.SetDeadline(time.Time{})
+}
+
+func (s *proxyServer) authorized(username, password string) bool {
+	return subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+}
+
+// relay sends what r has already buffered to remote, then pipes conn and remote.
+func relay(conn net.Conn, r *bufio.Reader, remote net.Conn) {
+	if n := r.Buffered(); n > 0 {
+		buf, _ := r.Peek(n)
+		if _, err := remote.Write(buf); err != nil {
+			_ = remote.Close()
+			return
+		}
+	}
+	pipe(conn, remote)
+}
+
+// pipe relays between a and b until either side is done.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyConn := func(dst, src net.Conn) {
+		defer wg.Done()
+		buf := bufferPool.Get().([]byte)
+		_, _ = io.CopyBuffer(dst, src, buf)
+		bufferPool.Put(buf)
+		_ = dst.Close()
+		_ = src.Close()
+	}
+	go copyConn(a, b)
+	go copyConn(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,294 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/client/tun/transport/argo"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScanCIDRs are the Cloudflare IPv4 ranges, https://www.cloudflare.com/ips-v4.
+var DefaultScanCIDRs = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22", "141.101.64.0/18",
+	"108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22", "198.41.128.0/17",
+	"162.158.0.0/15", "104.16.0.0/13", "104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+}
+
+const (
+	defaultScanTimeout       = 2000
+	defaultScanConcurrency   = 32
+	defaultScanMaxHosts      = 16
+	defaultScanSpeedDuration = 5
+)
+
+// Scan configures "cftun scan".
+type Scan struct {
+	CIDRs       []string
+	Ports       []int
+	Url         string // tunnel hostname, with path if any
+	Scheme      string // ws or wss, by port when empty
+	AuthKey     string
+	Timeout     int // milliseconds
+	Concurrency int
+	Rate        int // new connections per second, 0 for no limit
+	MaxHosts    int
+	Top         int
+	// SpeedUrl is downloaded through each of the top results to measure throughput.
+	SpeedUrl      string
+	SpeedDuration int // seconds
+	// TLS is used for the handshakes, with the url host as SNI by default.
+	TLS *TLS
+	// Headers and Access are sent with the upgrades.
+	Headers map[string]string
+	Access  *Access
+}
+
+type ScanResult struct {
+	Address string        `json:"address"`
+	Connect time.Duration `json:"connect"`
+	TLS     time.Duration `json:"tls"`
+	Upgrade time.Duration `json:"upgrade"`
+	// Status is the HTTP status of the upgrade, 101 when the websocket was accepted.
+	Status int     `json:"status"`
+	Colo   string  `json:"colo"`
+	Speed  float64 `json:"speed,omitempty"` // bytes per second
+}
+
+func (r *ScanResult) Latency() time.Duration {
+	return r.Connect + r.TLS + r.Upgrade
+}
+
+// ScanEdges measures TCP connect, TLS handshake and websocket upgrade through
+// every address, and returns the reachable ones with accepted upgrades first,
+// then by latency.
+func ScanEdges(opts *Scan) ([]*ScanResult, error) {
+	if opts.Url == "" {
+		return nil, errors.New("missing url")
+	}
+	cidrs, ports := opts.CIDRs, opts.Ports
+	if len(cidrs) == 0 {
+		cidrs = DefaultScanCIDRs
+	}
+	if len(ports) == 0 {
+		ports = []int{443}
+	}
+	timeout := time.Duration(opts.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultScanTimeout * time.Millisecond
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultScanConcurrency
+	}
+	maxHosts := opts.MaxHosts
+	if maxHosts <= 0 {
+		maxHosts = defaultScanMaxHosts
+	}
+	tlsConfig := &tls.Config{}
+	if opts.TLS != nil {
+		var err error
+		if tlsConfig, err = opts.TLS.build(); err != nil {
+			return nil, err
+		}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = strings.Split(opts.Url, "/")[0]
+	}
+	extra, err := buildHeaders(opts.Headers, opts.Access)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("User-Agent", "DEV")
+	addHeaders(header, extra)
+	header.Set("Forward-Proto", argo.ProtoInband)
+	if opts.AuthKey != "" {
+		header.Set("Forward-Key", opts.AuthKey)
+	}
+
+	var endpoints []netip.AddrPort
+	for _, cidr := range cidrs {
+		addrs, err := argo.SampleAddrs(cidr, maxHosts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s: %w", cidr, err)
+		}
+		for _, addr := range addrs {
+			for _, port := range ports {
+				endpoints = append(endpoints, netip.AddrPortFrom(addr, uint16(port)))
+			}
+		}
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []*ScanResult
+		sem     = make(chan struct{}, concurrency)
+	)
+	for _, endpoint := range endpoints {
+		if tick != nil {
+			<-tick
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(endpoint netip.AddrPort) {
+			defer func() { <-sem; wg.Done() }()
+			if result := scanEdge(opts, endpoint, tlsConfig, header, timeout); result != nil {
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}(endpoint)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		ok1, ok2 := results[i].Status == http.StatusSwitchingProtocols, results[j].Status == http.StatusSwitchingProtocols
+		if ok1 != ok2 {
+			return ok1
+		}
+		return results[i].Latency() < results[j].Latency()
+	})
+	if opts.Top > 0 && len(results) > opts.Top {
+		results = results[:opts.Top]
+	}
+
+	if opts.SpeedUrl != "" {
+		duration := time.Duration(opts.SpeedDuration) * time.Second
+		if duration <= 0 {
+			duration = defaultScanSpeedDuration * time.Second
+		}
+		// One at a time, so that the downloads do not share the bandwidth.
+		for _, result := range results {
+			result.Speed = measureSpeed(opts.SpeedUrl, result.Address, duration, timeout)
+		}
+	}
+	return results, nil
+}
+
+func scanScheme(scheme string, port int) string {
+	if scheme != "" {
+		return scheme
+	}
+	return (&Config{CdnPort: port}).getScheme()
+}
+
+// scanEdge returns nil when endpoint cannot be reached or fails the TLS handshake.
+func scanEdge(opts *Scan, endpoint netip.AddrPort, tlsConfig *tls.Config, header http.Header, timeout time.Duration) *ScanResult {
+	result := &ScanResult{Address: endpoint.String()}
+	scheme := scanScheme(opts.Scheme, int(endpoint.Port()))
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", endpoint.String(), timeout)
+	if err != nil {
+		return nil
+	}
+	result.Connect = time.Since(start)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	var tlsConn net.Conn
+	if scheme == "wss" {
+		start = time.Now()
+		c := tls.Client(conn, tlsConfig)
+		if err = c.Handshake(); err != nil {
+			return nil
+		}
+		result.TLS = time.Since(start)
+		tlsConn = c
+	}
+
+	// Upgrade over the connection measured above.
+	d := &websocket.Dialer{
+		HandshakeTimeout: timeout,
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		NetDialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+			return tlsConn, nil
+		},
+	}
+	start = time.Now()
+	wsConn, resp, _ := d.Dial(fmt.Sprintf("%s://%s", scheme, opts.Url), header)
+	result.Upgrade = time.Since(start)
+	if wsConn != nil {
+		_ = wsConn.Close()
+	}
+	if resp == nil {
+		return nil
+	}
+	if resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	result.Status = resp.StatusCode
+	if ray := resp.Header.Get("Cf-Ray"); strings.Contains(ray, "-") {
+		result.Colo = ray[strings.LastIndex(ray, "-")+1:]
+	}
+	return result
+}
+
+// measureSpeed downloads speedUrl through address for at most duration and
+// returns the throughput in bytes per second.
+func measureSpeed(speedUrl, address string, duration, timeout time.Duration) float64 {
+	u, err := url.Parse(speedUrl)
+	if err != nil {
+		return 0
+	}
+	host, _, _ := net.SplitHostPort(address)
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	target := net.JoinHostPort(host, port)
+	client := &http.Client{
+		Timeout: duration + timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: timeout}).DialContext(ctx, network, target)
+			},
+		},
+	}
+	resp, err := client.Get(speedUrl)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0
+	}
+
+	start := time.Now()
+	var total int64
+	buf := make([]byte, 32<<10)
+	for time.Since(start) < duration {
+		n, err := resp.Body.Read(buf)
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0
+		}
+	}
+	return float64(total) / time.Since(start).Seconds()
+}
@@ -0,0 +1,386 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthRejected = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSuccess         = 0x00
+	socksRepFailure         = 0x01
+	socksRepCmdUnsupported  = 0x07
+	socksRepAtypUnsupported = 0x08
+
+	defaultSocksUdpTimeout = 60
+)
+
+// Socks is a SOCKS5 inbound, every request is forwarded with its target in
+// Forward-Dest.
+type Socks struct {
+	Listen   string `yaml:"listen" json:"listen"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	Url      string `yaml:"url" json:"url"`
+	AuthKey  string `yaml:"auth-key" json:"auth-key"`
+	// PoolSize pre-dials connections for IP targets, which carry the target in-band.
+	PoolSize   int32 `yaml:"pool-size" json:"pool-size"`
+	UdpTimeout int   `yaml:"udp-timeout" json:"udp-timeout"` // seconds
+}
+
+func (c *Config) runSocks(s *Socks) {
+	server := c.newProxyServer("socks", s.Url, s.AuthKey, s.PoolSize, s.Username, s.Password)
+	server.udpTimeout = time.Duration(s.UdpTimeout) * time.Second
+	server.serve("SOCKS5", s.Listen, server.serveSocks)
+}
+
+func (s *proxyServer) serveSocks(conn net.Conn, r *bufio.Reader) {
+	if err := s.socksHandshake(r, conn); err != nil {
+		log.Debugln("[SOCKS] %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	cmd, target, err := readSocksRequest(r)
+	if err != nil {
+		if errors.Is(err, errSocksAtyp) {
+			_ = writeSocksReply(conn, socksRepAtypUnsupported, nil)
+		}
+		log.Debugln("[SOCKS] %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	handshakeDone(conn)
+
+	switch cmd {
+	case socksCmdConnect:
+		s.socksConnect(conn, r, target)
+	case socksCmdUDPAssociate:
+		s.socksAssociate(conn)
+	default:
+		_ = writeSocksReply(conn, socksRepCmdUnsupported, nil)
+	}
+}
+
+func (s *proxyServer) socksHandshake(r *bufio.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	method := byte(socksAuthNone)
+	if s.username != "" {
+		method = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		_, _ = w.Write([]byte{socksVersion, socksAuthRejected})
+		return errors.New("no acceptable auth method")
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == socksAuthNone {
+		return nil
+	}
+
+	// RFC 1929 username/password negotiation.
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return err
+	}
+	plen, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	password := make([]byte, plen)
+	if _, err = io.ReadFull(r, password); err != nil {
+		return err
+	}
+	if !s.authorized(string(username), string(password)) {
+		_, _ = w.Write([]byte{1, 1})
+		return errors.New("invalid username or password")
+	}
+	_, err = w.Write([]byte{1, 0})
+	return err
+}
+
+var errSocksAtyp = errors.New("unsupported address type")
+
+func readSocksRequest(r *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	target, err := readSocksAddr(r)
+	return header[1], target, err
+}
+
+// readSocksAddr reads ATYP, DST.ADDR and DST.PORT. Domains are kept as they
+// are, so that they are resolved by the server.
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, 4)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errSocksAtyp
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSocksAddr encodes address, an IP or domain with port, as ATYP, ADDR and PORT.
+func appendSocksAddr(b []byte, address string) []byte {
+	host, portStr, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portStr)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			b = append(b, socksAtypIPv4)
+		} else {
+			b = append(b, socksAtypIPv6)
+		}
+		b = append(b, addr.AsSlice()...)
+	} else {
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSocksReply(w io.Writer, rep byte, bind net.Addr) error {
+	address := "0.0.0.0:0"
+	if bind != nil {
+		address = bind.String()
+	}
+	_, err := w.Write(appendSocksAddr([]byte{socksVersion, rep, 0}, address))
+	return err
+}
+
+func (s *proxyServer) socksConnect(conn net.Conn, r *bufio.Reader, target string) {
+	remote, err := s.argo.DialAddress("tcp", target, nil)
+	if err != nil {
+		log.Warnln("[SOCKS] dial %s: %v", target, err)
+		_ = writeSocksReply(conn, socksRepFailure, nil)
+		return
+	}
+	defer remote.Close()
+	if err = writeSocksReply(conn, socksRepSuccess, conn.LocalAddr()); err != nil {
+		return
+	}
+	log.Debugln("[SOCKS] %s <-> %s", conn.RemoteAddr(), target)
+	// The reader may already hold data sent right after the request.
+	relay(conn, r, remote)
+}
+
+// socksAssociate relays datagrams until the control connection closes, with one
+// websocket per client address and destination.
+func (s *proxyServer) socksAssociate(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = writeSocksReply(conn, socksRepFailure, nil)
+		return
+	}
+	defer relay.Close()
+	if err = writeSocksReply(conn, socksRepSuccess, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	timeout := s.udpTimeout
+	if timeout <= 0 {
+		timeout = defaultSocksUdpTimeout * time.Second
+	}
+	a := &socksAssociation{
+		server:   s,
+		relay:    relay,
+		timeout:  timeout,
+		clientIP: addrIP(conn.RemoteAddr()),
+		flows:    make(map[string]net.Conn),
+	}
+	go a.serve()
+	// The association ends with its TCP connection.
+	_, _ = io.Copy(io.Discard, conn)
+	a.close()
+}
+
+type socksAssociation struct {
+	server  *proxyServer
+	relay   net.PacketConn
+	timeout time.Duration
+	// clientIP is the only source accepted, the relay is not open to anyone else.
+	clientIP netip.Addr
+
+	mu     sync.Mutex
+	closed bool
+	flows  map[string]net.Conn
+}
+
+func (a *socksAssociation) serve() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, client, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if addrIP(client) != a.clientIP {
+			continue
+		}
+		// RSV(2) FRAG(1), fragmented datagrams are dropped.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytesReader(buf[3:n])
+		target, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		flow, err := a.flow(client, target)
+		if err != nil {
+			log.Warnln("[SOCKS] dial udp %s: %v", target, err)
+			continue
+		}
+		_, _ = flow.Write(r.rest())
+	}
+}
+
+func (a *socksAssociation) flow(client net.Addr, target string) (net.Conn, error) {
+	key := client.String() + "|" + target
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if flow, ok := a.flows[key]; ok {
+		return flow, nil
+	}
+	flow, err := a.server.argo.DialAddress("udp", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.flows[key] = flow
+	go a.reply(key, flow, client, target)
+	return flow, nil
+}
+
+// reply sends the datagrams of flow back to client until it is idle for the timeout.
+func (a *socksAssociation) reply(key string, flow net.Conn, client net.Addr, target string) {
+	defer func() {
+		a.mu.Lock()
+		delete(a.flows, key)
+		a.mu.Unlock()
+		_ = flow.Close()
+	}()
+	header := appendSocksAddr([]byte{0, 0, 0}, target)
+	buf := make([]byte, 64<<10)
+	for {
+		_ = flow.SetReadDeadline(time.Now().Add(a.timeout))
+		n, err := flow.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = a.relay.WriteTo(append(header[:len(header):len(header)], buf[:n]...), client); err != nil {
+			return
+		}
+	}
+}
+
+func (a *socksAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	for _, flow := range a.flows {
+		_ = flow.Close()
+	}
+}
+
+// addrIP returns the IP of a TCP or UDP address.
+func addrIP(addr net.Addr) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// byteReader reads a datagram header and hands out the payload that follows.
+type byteReader struct {
+	b []byte
+}
+
+func bytesReader(b []byte) *byteReader {
+	return &byteReader{b: b}
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func (r *byteReader) rest() []byte {
+	return r.b
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"os"
+	"strings"
+)
+
+// TLS configures the handshake of wss websockets.
+type TLS struct {
+	// ServerName is sent in SNI instead of the url host, which stays in the Host header.
+	ServerName string `yaml:"server-name" json:"server-name"`
+	// CAFile holds PEM certificates trusted in addition to the system roots,
+	// for fronts with a private CA.
+	CAFile string `yaml:"ca-file" json:"ca-file"`
+	// CertFile and KeyFile are the client certificate, e.g. for Cloudflare Access mTLS.
+	CertFile string `yaml:"cert-file" json:"cert-file"`
+	KeyFile  string `yaml:"key-file" json:"key-file"`
+	// PinSha256 are base64 SHA-256 digests of public keys, one of which the
+	// server certificate chain must contain.
+	PinSha256  []string `yaml:"pin-sha256" json:"pin-sha256"`
+	MinVersion string   `yaml:"min-version" json:"min-version"` // 1.0, 1.1, 1.2 or 1.3
+	MaxVersion string   `yaml:"max-version" json:"max-version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (t *TLS) build() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: t.ServerName}
+	var ok bool
+	if t.MinVersion != "" {
+		if cfg.MinVersion, ok = tlsVersions[t.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown min-version %s", t.MinVersion)
+		}
+	}
+	if t.MaxVersion != "" {
+		if cfg.MaxVersion, ok = tlsVersions[t.MaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown max-version %s", t.MaxVersion)
+		}
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", t.CAFile)
+		}
+		cfg.RootCAs = roots
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.PinSha256) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range t.PinSha256 {
+			pins[strings.TrimPrefix(pin, "sha256//")] = true
+		}
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return errors.New("tls: no pinned public key in the server certificate chain")
+		}
+	}
+	return cfg, nil
+}
+
+// tlsConfig returns the TLS settings of a tunnel, the client ones when t is
+// nil, or nil when neither is set.
+func (c *Config) tlsConfig(t *TLS) *tls.Config {
+	if t == nil {
+		t = c.TLS
+	}
+	if t == nil {
+		return nil
+	}
+	cfg, err := t.build()
+	if err != nil {
+		log.Fatalln("Invalid tls settings: %v", err)
+	}
+	return cfg
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"github.com/fmnx/cftun/client/tun/dialer"
+	"github.com/fmnx/cftun/log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TransparentModeRedirect = "redirect"
+	TransparentModeTproxy   = "tproxy"
+
+	defaultTproxyMark  = 0x162
+	defaultTproxyTable = 162
+	defaultRoutingMark = 0xff
+)
+
+// Transparent receives the connections redirected to it by nftables and
+// forwards them to their original destination.
+type Transparent struct {
+	Listen string `yaml:"listen" json:"listen"`
+	// Mode is redirect (tcp only) or tproxy (tcp and udp).
+	Mode       string `yaml:"mode" json:"mode"`
+	Url        string `yaml:"url" json:"url"`
+	AuthKey    string `yaml:"auth-key" json:"auth-key"`
+	PoolSize   int32  `yaml:"pool-size" json:"pool-size"`
+	UdpTimeout int    `yaml:"udp-timeout" json:"udp-timeout"` // seconds
+	// AutoRules installs the nftables rules on start and removes them on exit.
+	AutoRules bool `yaml:"auto-rules" json:"auto-rules"`
+	// ExRoutes are destinations that are never intercepted.
+	ExRoutes []string `yaml:"ex-routes" json:"ex-routes"`
+	// Mark routes intercepted packets to the local tproxy listener.
+	Mark int `yaml:"mark" json:"mark"`
+	// RoutingMark is set on cftun's own connections, which the rules skip.
+	RoutingMark int `yaml:"routing-mark" json:"routing-mark"`
+}
+
+func (c *Config) runTransparent(t *Transparent) {
+	if t.Mode == "" {
+		t.Mode = TransparentModeRedirect
+	}
+	if t.Mode != TransparentModeRedirect && t.Mode != TransparentModeTproxy {
+		log.Fatalln("Unknown transparent mode: %s", t.Mode)
+	}
+	if t.Mark == 0 {
+		t.Mark = defaultTproxyMark
+	}
+	if t.RoutingMark != 0 {
+		dialer.DefaultRoutingMark.Store(int32(t.RoutingMark))
+	} else if dialer.DefaultRoutingMark.Load() == 0 {
+		dialer.DefaultRoutingMark.Store(defaultRoutingMark)
+	}
+	// Our own DNS queries must carry the routing mark too, or the rules send them back to us.
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: dialer.DialContext}
+
+	server := c.newProxyServer("transparent", t.Url, t.AuthKey, t.PoolSize, "", "")
+	server.udpTimeout = time.Duration(t.UdpTimeout) * time.Second
+	if server.udpTimeout <= 0 {
+		server.udpTimeout = defaultSocksUdpTimeout * time.Second
+	}
+
+	if t.AutoRules {
+		_, portStr, _ := net.SplitHostPort(t.Listen)
+		port, _ := strconv.Atoi(portStr)
+		if err := t.setupRules(port, c.bypassAddresses(t.Url, t.ExRoutes)); err != nil {
+			log.Fatalln("Failed to set up transparent proxy rules: %v", err)
+		}
+	}
+	t.serve(server)
+}
+
+// reservedRoutes are never intercepted, so that local networks stay reachable.
+var reservedRoutes = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// bypassAddresses returns the reserved ranges, the CDN addresses, those of url
+// when no CDN IP is set, and exRoutes.
+func (c *Config) bypassAddresses(url string, exRoutes []string) []netip.Prefix {
+	routes := append(append([]string{}, reservedRoutes...), exRoutes...)
+	routes = append(routes, c.CdnIps...)
+	hosts := []string{c.CdnIp}
+	if c.CdnIp == "" && len(c.CdnIps) == 0 {
+		hosts = []string{strings.Split(c.GlobalUrl, "/")[0], strings.Split(url, "/")[0]}
+	}
+	for _, host := range hosts {
+		if _, err := netip.ParseAddr(host); err == nil {
+			routes = append(routes, host)
+		} else if host != "" {
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				log.Warnln("Failed to resolve %s, its connections may be intercepted: %v", host, err)
+			}
+			for _, ip := range ips {
+				routes = append(routes, ip.String())
+			}
+		}
+	}
+
+	var prefixes []netip.Prefix
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			addr, err := netip.ParseAddr(route)
+			if err != nil {
+				log.Warnln("Invalid transparent ex-route: %s", route)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// CleanupTransparent removes the rules installed by a transparent inbound.
+func CleanupTransparent() {
+	cleanupTransparentRules()
+}
@@ -0,0 +1,324 @@
+//go:build linux
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/fmnx/cftun/client/tun/dialer"
+	"github.com/fmnx/cftun/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	nftTable = "cftun"
+
+	// ip6t_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+	ip6tSoOriginalDst = 80
+)
+
+var (
+	rulesMu      sync.Mutex
+	rulesCleanup []*exec.Cmd
+	exitHandler  sync.Once
+)
+
+func (t *Transparent) serve(server *proxyServer) {
+	tproxy := t.Mode == TransparentModeTproxy
+	lc := &net.ListenConfig{}
+	if tproxy {
+		lc.Control = transparentControl(false)
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", t.Listen)
+	if err != nil {
+		log.Fatalln("Failed to listen on %s: %v", t.Listen, err)
+	}
+	log.Infoln("Transparent proxy (%s) listen on %s", t.Mode, t.Listen)
+
+	if tproxy {
+		go t.serveUDP(server)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Errorln("Transparent accept error: %v", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			var target string
+			if tproxy {
+				// With TPROXY the socket keeps the original destination as its local address.
+				target = conn.LocalAddr().String()
+			} else if target, err = originalDst(conn.(*net.TCPConn)); err != nil {
+				log.Warnln("[TRANSPARENT] %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			remote, err := server.argo.DialAddress("tcp", target, nil)
+			if err != nil {
+				log.Warnln("[TRANSPARENT] dial %s: %v", target, err)
+				return
+			}
+			log.Debugln("[TRANSPARENT] %s <-> %s", conn.RemoteAddr(), target)
+			relay(conn, bufio.NewReader(conn), remote)
+		}()
+	}
+}
+
+// originalDst reads the destination of a connection redirected by netfilter.
+func originalDst(conn *net.TCPConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	is4 := netip.MustParseAddrPort(conn.RemoteAddr().String()).Addr().Unmap().Is4()
+	var target string
+	err2 := raw.Control(func(fd uintptr) {
+		if is4 {
+			// sockaddr_in fits in the 16 bytes of an IPv6Mreq.
+			var mreq *unix.IPv6Mreq
+			if mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); err == nil {
+				addr := netip.AddrFrom4([4]byte(mreq.Multiaddr[4:8]))
+				target = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(mreq.Multiaddr[2:4])).String()
+			}
+			return
+		}
+		// sockaddr_in6 fits in the 32 bytes of an IPv6MTUInfo.
+		var info *unix.IPv6MTUInfo
+		if info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst); err == nil {
+			// The port field holds the network byte order bytes.
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			addr := netip.AddrFrom16(info.Addr.Addr)
+			target = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(port[:])).String()
+		}
+	})
+	if err2 != nil {
+		return "", err2
+	}
+	return target, err
+}
+
+// transparentControl enables IP_TRANSPARENT, so that a socket can accept
+// packets for, or send packets from, foreign addresses.
+func transparentControl(udp bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		err2 := c.Control(func(fd uintptr) {
+			set := func(level, opt int) {
+				if err == nil {
+					err = unix.SetsockoptInt(int(fd), level, opt, 1)
+				}
+			}
+			set(unix.SOL_SOCKET, unix.SO_REUSEADDR)
+			set(unix.SOL_IP, unix.IP_TRANSPARENT)
+			if !strings.HasSuffix(network, "4") {
+				set(unix.SOL_IPV6, unix.IPV6_TRANSPARENT)
+			}
+			if udp {
+				set(unix.SOL_IP, unix.IP_RECVORIGDSTADDR)
+				if !strings.HasSuffix(network, "4") {
+					set(unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR)
+				}
+			}
+			if mark := int(dialer.DefaultRoutingMark.Load()); err == nil && mark != 0 {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+			}
+		})
+		if err2 != nil {
+			return err2
+		}
+		return err
+	}
+}
+
+type transparentFlow struct {
+	remote net.Conn
+	reply  net.PacketConn
+}
+
+func (t *Transparent) serveUDP(server *proxyServer) {
+	lc := &net.ListenConfig{Control: transparentControl(true)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", t.Listen)
+	if err != nil {
+		log.Fatalln("Failed to listen on udp %s: %v", t.Listen, err)
+	}
+	conn := pc.(*net.UDPConn)
+
+	var mu sync.Mutex
+	flows := make(map[string]*transparentFlow)
+	buf := make([]byte, 64<<10)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			log.Errorln("Transparent udp read error: %v", err)
+			return
+		}
+		target, ok := parseOrigDst(oob[:oobn])
+		if !ok {
+			continue
+		}
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+		key := client.String() + "|" + target.String()
+
+		mu.Lock()
+		flow, ok := flows[key]
+		if !ok {
+			if flow, err = newTransparentFlow(server, target); err != nil {
+				mu.Unlock()
+				log.Warnln("[TRANSPARENT] dial udp %s: %v", target, err)
+				continue
+			}
+			flows[key] = flow
+			go func() {
+				flow.serve(client, server.udpTimeout)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		_, _ = flow.remote.Write(buf[:n])
+	}
+}
+
+func newTransparentFlow(server *proxyServer, target netip.AddrPort) (*transparentFlow, error) {
+	network := "udp6"
+	if target.Addr().Is4() {
+		network = "udp4"
+	}
+	// Replies are sent from the original destination.
+	lc := &net.ListenConfig{Control: transparentControl(false)}
+	reply, err := lc.ListenPacket(context.Background(), network, target.String())
+	if err != nil {
+		return nil, err
+	}
+	remote, err := server.argo.DialAddress("udp", target.String(), nil)
+	if err != nil {
+		_ = reply.Close()
+		return nil, err
+	}
+	return &transparentFlow{remote: remote, reply: reply}, nil
+}
+
+func (f *transparentFlow) serve(client netip.AddrPort, timeout time.Duration) {
+	defer f.reply.Close()
+	defer f.remote.Close()
+	buf := make([]byte, 64<<10)
+	for {
+		_ = f.remote.SetReadDeadline(time.Now().Add(timeout))
+		n, err := f.remote.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = f.reply.WriteTo(buf[:n], net.UDPAddrFromAddrPort(client)); err != nil {
+			return
+		}
+	}
+}
+
+// parseOrigDst finds the original destination in the control messages of a
+// datagram received with IP_RECVORIGDSTADDR.
+func parseOrigDst(oob []byte) (netip.AddrPort, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(data) >= 8:
+			addr := netip.AddrFrom4([4]byte(data[4:8]))
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(data[2:4])), true
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(data) >= 24:
+			addr := netip.AddrFrom16([16]byte(data[8:24])).Unmap()
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(data[2:4])), true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// setupRules installs the nftables table, and for tproxy the policy routing
+// that delivers marked packets locally.
+func (t *Transparent) setupRules(port int, bypass []netip.Prefix) error {
+	cleanupTransparentRules()
+	// Drop the table left behind by a previous run that did not exit cleanly.
+	_ = exec.Command("nft", "delete", "table", "inet", nftTable).Run()
+	var bypass4, bypass6 []string
+	for _, prefix := range bypass {
+		if prefix.Addr().Is4() {
+			bypass4 = append(bypass4, prefix.String())
+		} else {
+			bypass6 = append(bypass6, prefix.String())
+		}
+	}
+
+	var rules strings.Builder
+	fmt.Fprintf(&rules, "table inet %s {\n", nftTable)
+	fmt.Fprintf(&rules, "\tset bypass4 { type ipv4_addr; flags interval; auto-merge; elements = { %s } }\n", strings.Join(bypass4, ", "))
+	fmt.Fprintf(&rules, "\tset bypass6 { type ipv6_addr; flags interval; auto-merge; elements = { %s } }\n", strings.Join(bypass6, ", "))
+	skip := "\t\tfib daddr type local return\n\t\tip daddr @bypass4 return\n\t\tip6 daddr @bypass6 return\n"
+	own := fmt.Sprintf("\t\tmeta mark %d return\n", dialer.DefaultRoutingMark.Load())
+	if t.Mode == TransparentModeTproxy {
+		fmt.Fprintf(&rules, "\tchain prerouting {\n\t\ttype filter hook prerouting priority mangle; policy accept;\n%s", skip)
+		fmt.Fprintf(&rules, "\t\tmeta nfproto ipv4 meta l4proto { tcp, udp } meta mark set %d tproxy ip to :%d accept\n", t.Mark, port)
+		fmt.Fprintf(&rules, "\t\tmeta nfproto ipv6 meta l4proto { tcp, udp } meta mark set %d tproxy ip6 to :%d accept\n\t}\n", t.Mark, port)
+		fmt.Fprintf(&rules, "\tchain output {\n\t\ttype route hook output priority mangle; policy accept;\n%s%s", own, skip)
+		fmt.Fprintf(&rules, "\t\tmeta l4proto { tcp, udp } meta mark set %d\n\t}\n", t.Mark)
+	} else {
+		fmt.Fprintf(&rules, "\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n%s", skip)
+		fmt.Fprintf(&rules, "\t\tmeta l4proto tcp redirect to :%d\n\t}\n", port)
+		fmt.Fprintf(&rules, "\tchain output {\n\t\ttype nat hook output priority -100; policy accept;\n%s%s", own, skip)
+		fmt.Fprintf(&rules, "\t\tmeta l4proto tcp redirect to :%d\n\t}\n", port)
+	}
+	rules.WriteString("}\n")
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(rules.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	rulesMu.Lock()
+	rulesCleanup = append(rulesCleanup, exec.Command("nft", "delete", "table", "inet", nftTable))
+	rulesMu.Unlock()
+	// Fatal errors exit without going through the signal handler.
+	exitHandler.Do(func() { log.RegisterExitHandler(cleanupTransparentRules) })
+
+	if t.Mode == TransparentModeTproxy {
+		mark, table := fmt.Sprint(t.Mark), fmt.Sprint(defaultTproxyTable)
+		for _, family := range []string{"-4", "-6"} {
+			if out, err := exec.Command("ip", family, "rule", "add", "fwmark", mark, "lookup", table).CombinedOutput(); err != nil {
+				log.Errorln("Failed to add ip %s rule: %v: %s", family, err, strings.TrimSpace(string(out)))
+			}
+			if out, err := exec.Command("ip", family, "route", "add", "local", "default", "dev", "lo", "table", table).CombinedOutput(); err != nil {
+				log.Errorln("Failed to add ip %s route: %v: %s", family, err, strings.TrimSpace(string(out)))
+			}
+			rulesMu.Lock()
+			rulesCleanup = append(rulesCleanup,
+				exec.Command("ip", family, "rule", "del", "fwmark", mark, "lookup", table),
+				exec.Command("ip", family, "route", "flush", "table", table))
+			rulesMu.Unlock()
+		}
+	}
+	log.Infoln("Transparent proxy rules installed (table inet %s).", nftTable)
+	return nil
+}
+
+func cleanupTransparentRules() {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	for _, cmd := range rulesCleanup {
+		_ = cmd.Run()
+	}
+	rulesCleanup = nil
+}
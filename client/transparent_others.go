@@ -0,0 +1,18 @@
+//go:build !linux
+
+package client
+
+import (
+	"github.com/fmnx/cftun/log"
+	"net/netip"
+)
+
+func (t *Transparent) serve(_ *proxyServer) {
+	log.Errorln("Transparent proxy is only supported on Linux.")
+}
+
+func (t *Transparent) setupRules(_ int, _ []netip.Prefix) error {
+	return nil
+}
+
+func cleanupTransparentRules() {}
@@ -80,3 +80,8 @@ func ListenPacketWithOptions(network, address string, opts *Options) (net.Packet
 	}
 	return lc.ListenPacket(context.Background(), network, address)
 }
+
+// Control applies opts to a socket before it connects, for use as net.Dialer.Control.
+func (opts *Options) Control(network, address string, c syscall.RawConn) error {
+	return setSocketOptions(network, address, c, opts)
+}
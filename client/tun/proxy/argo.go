@@ -5,6 +5,8 @@ import (
 	M "github.com/fmnx/cftun/client/tun/metadata"
 	"github.com/fmnx/cftun/client/tun/transport/argo"
 	"net"
+	"net/http"
+	"net/netip"
 	"sync"
 )
 
@@ -49,6 +51,74 @@ func (a *Argo) Dial(metadata *M.Metadata) (net.Conn, error) {
 	return conn, nil
 }
 
+// Stats returns the pool statistics.
+func (a *Argo) Stats() argo.PoolStats {
+	return a.ws.Stats()
+}
+
+// Warmup fills the connection pool.
+func (a *Argo) Warmup() {
+	a.ws.Warmup()
+}
+
+// SetHeader adds a header sent on every connection, it must be called before the first Dial.
+func (a *Argo) SetHeader(key, value string) {
+	a.ws.SetHeader(key, value)
+}
+
+// DialHeader opens a new connection that carries its destination in header
+// instead of the in-band header.
+func (a *Argo) DialHeader(header http.Header) (net.Conn, error) {
+	return a.ws.DialHeader(header)
+}
+
+// DialAddress dials address, an IP or a hostname with port. IP destinations may
+// use a pooled connection, hostnames are passed in Forward-Dest unresolved so that
+// the server resolves them. A non-nil header always opens a new connection.
+// The in-band header of a pooled TCP connection is sent right away, the server
+// may speak first.
+func (a *Argo) DialAddress(network, address string, header http.Header) (net.Conn, error) {
+	if addrPort, err := netip.ParseAddrPort(address); err == nil && header == nil {
+		if metadata := addressMetadata(network, addrPort); metadata != nil {
+			conn, err := a.Dial(metadata)
+			if err != nil || metadata.Network != M.TCP {
+				return conn, err
+			}
+			if err = sendHeader(conn); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Forward-Dest", address)
+	header.Set("Forward-Proto", network)
+	return a.DialHeader(header)
+}
+
+func addressMetadata(network string, addrPort netip.AddrPort) *M.Metadata {
+	metadata := &M.Metadata{
+		DstIP:     addrPort.Addr().Unmap(),
+		DstPort:   addrPort.Port(),
+		IPVersion: 4,
+	}
+	if metadata.DstIP.Is6() {
+		metadata.IPVersion = 6
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		metadata.Network = M.TCP
+	case "udp", "udp4", "udp6":
+		metadata.Network = M.UDP
+	default:
+		return nil
+	}
+	return metadata
+}
+
 type argoConn struct {
 	net.Conn
 	header     []byte
@@ -81,6 +151,16 @@ func (w *argoConn) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// sendHeader sends the in-band destination of a pooled connection right away,
+// for protocols where the server speaks first. Other connections are left alone.
+func sendHeader(conn net.Conn) error {
+	if c, ok := conn.(*argoConn); ok {
+		_, err := c.Write(nil)
+		return err
+	}
+	return nil
+}
+
 func (w *argoConn) parseHeader(metadata *M.Metadata) {
 	hdrLen := 8
 	if metadata.DstIP.Is6() {
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	gobwas "github.com/gobwas/ws"
@@ -27,11 +29,143 @@ const (
 
 type PingPeriodContext string
 
+// Keepalive pings every websocket each Interval seconds, one that receives
+// nothing for Interval+Timeout seconds is closed. A negative Interval disables it.
+type Keepalive struct {
+	Interval int `yaml:"interval" json:"interval"`
+	Timeout  int `yaml:"timeout" json:"timeout"`
+}
+
+const (
+	defaultKeepaliveInterval = 10 * time.Second
+	defaultKeepaliveTimeout  = 10 * time.Second
+)
+
+func (k *Keepalive) durations() (interval, timeout time.Duration) {
+	interval, timeout = defaultKeepaliveInterval, defaultKeepaliveTimeout
+	if k == nil {
+		return
+	}
+	if k.Interval != 0 {
+		interval = time.Duration(k.Interval) * time.Second
+	}
+	if k.Timeout > 0 {
+		timeout = time.Duration(k.Timeout) * time.Second
+	}
+	return
+}
+
 // GorillaConn is a wrapper around the standard gorilla websocket but implements a ReadWriter
 // This is still used by access carrier
 type GorillaConn struct {
 	*websocket.Conn
 	readBuf bytes.Buffer
+
+	// timeout is the keepalive read allowance, 0 when keepalive is disabled.
+	timeout      time.Duration
+	mu           sync.Mutex
+	readDeadline time.Time
+	aliveUntil   time.Time
+	// pending is the read started by watch.
+	pending   chan readResult
+	dead      atomic.Bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type readResult struct {
+	message []byte
+	err     error
+}
+
+// NewGorillaConn wraps conn and starts its keepalive.
+func NewGorillaConn(conn *websocket.Conn, keepalive *Keepalive) *GorillaConn {
+	c := &GorillaConn{Conn: conn, done: make(chan struct{})}
+	interval, timeout := keepalive.durations()
+	if interval <= 0 {
+		return c
+	}
+	c.timeout = interval + timeout
+	conn.SetPongHandler(func(string) error {
+		c.alive()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		c.alive()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(timeout))
+		var netErr net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	})
+	go c.pinger(interval, timeout)
+	return c
+}
+
+func (c *GorillaConn) pinger(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+			c.dead.Store(true)
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+// alive extends the keepalive read deadline, on every frame from the server.
+func (c *GorillaConn) alive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aliveUntil = time.Now().Add(c.timeout)
+	_ = c.applyReadDeadline()
+}
+
+// applyReadDeadline sets the earlier of the caller's and the keepalive deadlines.
+func (c *GorillaConn) applyReadDeadline() error {
+	deadline := c.readDeadline
+	if c.timeout > 0 && (deadline.IsZero() || c.aliveUntil.Before(deadline)) {
+		deadline = c.aliveUntil
+	}
+	return c.Conn.SetReadDeadline(deadline)
+}
+
+// SetReadDeadline keeps the keepalive deadline when it is the earlier one.
+func (c *GorillaConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.applyReadDeadline()
+}
+
+// watch reads c while it waits in a pool, so that the pongs are handled and a
+// dead connection is noticed before it is used. Whatever it reads is returned
+// by the next Read.
+func (c *GorillaConn) watch() {
+	if c.timeout == 0 || c.pending != nil {
+		return
+	}
+	c.pending = make(chan readResult, 1)
+	c.alive()
+	go func() {
+		_, message, err := c.Conn.ReadMessage()
+		if err != nil {
+			c.dead.Store(true)
+		}
+		c.pending <- readResult{message, err}
+	}()
+}
+
+// Dead reports whether the keepalive failed.
+func (c *GorillaConn) Dead() bool {
+	return c.dead.Load()
 }
 
 // Read will read messages from the websocket connection
@@ -41,7 +175,20 @@ func (c *GorillaConn) Read(p []byte) (int, error) {
 		return c.readBuf.Read(p)
 	}
 
-	_, message, err := c.Conn.ReadMessage()
+	var (
+		message []byte
+		err     error
+	)
+	if c.pending != nil {
+		result := <-c.pending
+		c.pending = nil
+		message, err = result.message, result.err
+	} else {
+		if c.timeout > 0 {
+			c.alive()
+		}
+		_, message, err = c.Conn.ReadMessage()
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -68,7 +215,7 @@ func (c *GorillaConn) Write(p []byte) (int, error) {
 // "It is equivalent to calling both SetReadDeadline and SetWriteDeadline."
 // Note there is no synchronization here, but the gorilla implementation isn't thread safe anyway
 func (c *GorillaConn) SetDeadline(t time.Time) error {
-	if err := c.Conn.SetReadDeadline(t); err != nil {
+	if err := c.SetReadDeadline(t); err != nil {
 		return fmt.Errorf("error setting read deadline: %w", err)
 	}
 	if err := c.Conn.SetWriteDeadline(t); err != nil {
@@ -77,6 +224,12 @@ func (c *GorillaConn) SetDeadline(t time.Time) error {
 	return nil
 }
 
+// Close stops the keepalive and closes the websocket.
+func (c *GorillaConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
 type Conn struct {
 	rw  io.ReadWriter
 	log *zerolog.Logger
@@ -1,6 +1,8 @@
 package argo
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/fmnx/cftun/client/tun/dialer"
@@ -21,6 +23,33 @@ type Params struct {
 	Url      string `json:"url"`
 	Port     int    `json:"port"`
 	PoolSize int32  `json:"pool-size"`
+	AuthKey  string `json:"auth-key"`
+	// MaxIdleAge closes pooled connections idle for longer, in seconds, 0 keeps them.
+	MaxIdleAge int        `json:"max-idle-age"`
+	Keepalive  *Keepalive `json:"keepalive"`
+	// MinPoolSize and MaxPoolSize make the pool follow the dial rate, PoolSize
+	// is then ignored.
+	MinPoolSize int32 `json:"min-pool-size"`
+	MaxPoolSize int32 `json:"max-pool-size"`
+	// Name labels the pool statistics.
+	Name string `json:"name"`
+	// Edges replaces CdnIP when several CDN IPs are configured.
+	Edges *Edges `json:"-"`
+	// TLSConfig is used by wss connections, the defaults when nil.
+	TLSConfig *tls.Config `json:"-"`
+	// Headers are added to every connection, before Forward-*.
+	Headers http.Header `json:"-"`
+	// LocalIP binds the connections to a local address instead of the default interface.
+	LocalIP net.IP `json:"-"`
+}
+
+// ProtoInband is the Forward-Proto of connections that send their destination
+// in the first message.
+const ProtoInband = "inband"
+
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
 }
 
 type Websocket struct {
@@ -32,8 +61,21 @@ type Websocket struct {
 
 	mu        sync.Mutex
 	connCount *atomic.Int32
+	warm      atomic.Bool
 	stopChan  chan struct{}
-	connPool  chan net.Conn
+	connPool  chan pooledConn
+
+	// target is the size of an adaptive pool.
+	target  atomic.Int32
+	dialing atomic.Int32
+	// dials and misses since the last adaptation.
+	dials  atomic.Int64
+	missed atomic.Int64
+	stats  *poolStats
+	// fillFailures counts the failed dials since the last success, fill
+	// waits until backoffUntil, in unix nanoseconds.
+	fillFailures atomic.Int32
+	backoffUntil atomic.Int64
 }
 
 func NewWebsocket(params *Params) *Websocket {
@@ -42,7 +84,7 @@ func NewWebsocket(params *Params) *Websocket {
 	host := hostPath[0]
 
 	wsDialer := &websocket.Dialer{
-		TLSClientConfig:   nil,
+		TLSClientConfig:   params.TLSConfig,
 		Proxy:             http.ProxyFromEnvironment,
 		HandshakeTimeout:  time.Second,
 		ReadBufferSize:    32 << 10,
@@ -51,77 +93,211 @@ func NewWebsocket(params *Params) *Websocket {
 	}
 
 	address := net.JoinHostPort(params.CdnIP, strconv.Itoa(params.Port))
+	dialContext := dialer.DialContext
+	if params.LocalIP != nil {
+		dialContext = (&net.Dialer{LocalAddr: &net.TCPAddr{IP: params.LocalIP}}).DialContext
+	}
 	wsDialer.NetDial = func(network, addr string) (net.Conn, error) {
 		if params.CdnIP != "" {
-			return dialer.Dial(network, address)
+			return dialContext(context.Background(), network, address)
 		}
-		return dialer.Dial(network, addr)
+		return dialContext(context.Background(), network, addr)
+	}
+	if params.Edges != nil {
+		wsDialer.NetDialContext = params.Edges.NetDialContext(dialContext)
 	}
 
 	headers := make(http.Header)
 	headers.Set("Host", host)
 	headers.Set("User-Agent", "DEV")
+	for key, values := range params.Headers {
+		headers[key] = values
+	}
+	if params.AuthKey != "" {
+		headers.Set("Forward-Key", params.AuthKey)
+	}
 
+	capacity := params.PoolSize
+	if params.adaptive() {
+		capacity = params.MaxPoolSize
+	}
 	ws := &Websocket{
 		params:   params,
 		wsDialer: wsDialer,
 		headers:  headers,
 		Address:  address,
-		Url:      fmt.Sprintf("%s://%s", params.Scheme, host),
+		Url:      fmt.Sprintf("%s://%s", params.Scheme, params.Url),
 
 		connCount: &atomic.Int32{},
 		stopChan:  make(chan struct{}),
-		connPool:  make(chan net.Conn, params.PoolSize),
+		connPool:  make(chan pooledConn, capacity),
+		stats:     newPoolStats(params.Name, capacity > 0),
+	}
+	if capacity > 0 && params.MaxIdleAge > 0 {
+		go ws.evictLoop()
+	}
+	if params.adaptive() {
+		ws.target.Store(params.MinPoolSize)
+		go ws.adaptLoop()
+	} else {
+		ws.stats.target.Set(int64(params.PoolSize))
 	}
 	return ws
 }
 
 func (w *Websocket) Close() {
 	close(w.stopChan)
-	for conn := range w.connPool {
-		_ = conn.Close()
+	// connPool is never closed, take what is left without waiting.
+	for {
+		select {
+		case conn := <-w.connPool:
+			_ = conn.Close()
+		default:
+			return
+		}
 	}
 }
 
 func (w *Websocket) preDial() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.connCount.Load() >= w.params.PoolSize {
+	if w.connCount.Load() >= w.size() {
 		return
 	}
+	w.addConn()
+}
+
+// addConn dials a connection into the pool, it reports whether it was added.
+func (w *Websocket) addConn() bool {
 	select {
 	case <-w.stopChan:
-		return
+		return false
 	default:
 		conn, err := w.connect(nil)
 		if err != nil {
-			return
+			return false
 		}
+		conn.(*GorillaConn).watch()
 		select {
-		case w.connPool <- conn:
-			w.connCount.Add(1)
-			return
+		case <-w.stopChan:
+			// Closed while dialing, Close has drained the pool already.
+			_ = conn.Close()
+			return false
+		case w.connPool <- pooledConn{conn, time.Now()}:
+			w.stats.size.Set(int64(w.connCount.Add(1)))
+			return true
 		default:
 			_ = conn.Close()
+			return false
+		}
+	}
+}
+
+func (w *Websocket) size() int32 {
+	if w.params.adaptive() {
+		return w.target.Load()
+	}
+	return w.params.PoolSize
+}
+
+// Warmup fills the pool instead of waiting for the connections to be used,
+// and with MaxIdleAge keeps it full. An adaptive pool always does.
+func (w *Websocket) Warmup() {
+	if w.params.adaptive() {
+		w.fill()
+		return
+	}
+	w.warm.Store(true)
+	for i := w.connCount.Load(); i < w.params.PoolSize; i++ {
+		w.preDial()
+	}
+}
+
+func (w *Websocket) stale(conn pooledConn) bool {
+	if conn.Conn.(*GorillaConn).Dead() {
+		return true
+	}
+	return w.params.MaxIdleAge > 0 && time.Since(conn.dialed) > time.Duration(w.params.MaxIdleAge)*time.Second
+}
+
+// evictLoop closes the pooled connections older than MaxIdleAge, before the
+// edge or a middlebox drops them silently, and the ones whose keepalive failed.
+func (w *Websocket) evictLoop() {
+	ticker := time.NewTicker(time.Duration(w.params.MaxIdleAge) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case <-ticker.C:
+		}
+		evicted := 0
+		for n := len(w.connPool); n > 0; n-- {
+			var conn pooledConn
+			select {
+			case conn = <-w.connPool:
+			default:
+			}
+			if conn.Conn == nil {
+				break
+			}
+			if !w.stale(conn) {
+				w.connPool <- conn
+				continue
+			}
+			w.stats.size.Set(int64(w.connCount.Add(-1)))
+			w.stats.evictions.Inc()
+			_ = conn.Close()
+			evicted++
+		}
+		if w.params.adaptive() {
+			w.fill()
+			continue
+		}
+		if w.warm.Load() {
+			w.Warmup()
+			continue
+		}
+		for ; evicted > 0; evicted-- {
+			w.preDial()
 		}
 	}
 }
 
+// SetHeader adds a header sent on every connection, it must be called before the first Dial.
+func (w *Websocket) SetHeader(key, value string) {
+	w.headers.Set(key, value)
+}
+
 func (w *Websocket) header(metadata *metadata.Metadata) http.Header {
+	header := w.headers.Clone()
 	if metadata == nil {
-		return w.headers
+		// The destination follows in-band, the server must not pick a default one.
+		header.Set("Forward-Proto", ProtoInband)
+		return header
 	}
 
-	header := make(http.Header, len(w.headers))
-	header.Set("Host", w.headers.Get("Host"))
-	header.Set("User-Agent", "DEV")
 	header.Set("Forward-Dest", metadata.DestinationAddress())
 	header.Set("Forward-Proto", metadata.Network.String())
 	return header
 }
 
 func (w *Websocket) connect(metadata *metadata.Metadata) (net.Conn, error) {
-	wsConn, resp, err := w.wsDialer.Dial(w.Url, w.header(metadata))
+	return w.dial(w.header(metadata))
+}
+
+func (w *Websocket) dial(header http.Header) (net.Conn, error) {
+	var (
+		wsConn *websocket.Conn
+		resp   *http.Response
+		err    error
+	)
+	start := time.Now()
+	if w.params.Edges != nil {
+		wsConn, resp, err = w.params.Edges.Handshake(w.wsDialer, w.Url, header)
+	} else {
+		wsConn, resp, err = w.wsDialer.Dial(w.Url, header)
+	}
 	if resp != nil && resp.Body != nil {
 		_ = resp.Body.Close()
 	}
@@ -129,22 +305,51 @@ func (w *Websocket) connect(metadata *metadata.Metadata) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	w.stats.observe(time.Since(start))
+	if w.fillFailures.Swap(0) > 0 {
+		w.backoffUntil.Store(0)
+	}
 
-	return &GorillaConn{Conn: wsConn}, nil
+	return NewGorillaConn(wsConn, w.params.Keepalive), nil
+}
+
+// DialHeader opens a new connection, bypassing the pool, with header added to the common headers.
+func (w *Websocket) DialHeader(header http.Header) (net.Conn, error) {
+	merged := w.headers.Clone()
+	for key, values := range header {
+		merged[key] = values
+	}
+	return w.dial(merged)
 }
 
 func (w *Websocket) Dial(metadata *metadata.Metadata) (conn net.Conn, headerSent bool, err error) {
-	defer func() { go w.preDial() }()
-	select {
-	case <-w.stopChan:
-		err = errors.New("websocket has been closed")
-		return
-	case conn = <-w.connPool:
-		w.connCount.Add(-1)
-		return
-	default:
-		conn, err = w.connect(metadata)
-		headerSent = true
-		return
+	if w.params.adaptive() {
+		w.dials.Add(1)
+		defer w.fill()
+	} else {
+		defer func() { go w.preDial() }()
+	}
+	for {
+		select {
+		case <-w.stopChan:
+			err = errors.New("websocket has been closed")
+			return
+		case pooled := <-w.connPool:
+			w.stats.size.Set(int64(w.connCount.Add(-1)))
+			if w.stale(pooled) {
+				w.stats.evictions.Inc()
+				_ = pooled.Close()
+				continue
+			}
+			w.stats.hits.Inc()
+			conn = pooled.Conn
+			return
+		default:
+			w.stats.misses.Inc()
+			w.missed.Add(1)
+			conn, err = w.connect(metadata)
+			headerSent = true
+			return
+		}
 	}
 }
@@ -0,0 +1,389 @@
+package argo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/fmnx/cftun/client/tun/dialer"
+	"github.com/fmnx/cftun/log"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPrefixEdges is the number of addresses sampled from each CIDR.
+	maxPrefixEdges     = 16
+	probeTimeout       = 5 * time.Second
+	probeConcurrency   = 16
+	handshakeAttempts  = 3
+	happyEyeballsDelay = 250 * time.Millisecond
+	// failureDecay weights the previous handshakes in the failure rate.
+	failureDecay = 0.8
+)
+
+// Edges ranks the Cloudflare anycast addresses by handshake latency and
+// failure rate, every websocket dials the current best one.
+type Edges struct {
+	port     int
+	url      string
+	header   http.Header
+	interval time.Duration
+	tls      *tls.Config
+
+	mu    sync.RWMutex
+	edges []*edge
+	best  netip.Addr
+}
+
+type edge struct {
+	addr     netip.Addr
+	latency  time.Duration // moving average, probeTimeout until the first success
+	attempts float64
+	failures float64
+}
+
+func (e *edge) score() float64 {
+	rate := 0.0
+	if e.attempts > 0 {
+		rate = e.failures / e.attempts
+	}
+	return float64(e.latency) * (1 + 10*rate)
+}
+
+// NewEdges returns nil when addrs, IPs or CIDRs, holds no address. url, header
+// and tlsConfig are used for the probes, which run every interval.
+func NewEdges(addrs []string, port int, url string, header http.Header, interval time.Duration, tlsConfig *tls.Config) *Edges {
+	e := &Edges{
+		port:     port,
+		url:      url,
+		header:   header,
+		interval: interval,
+		tls:      tlsConfig,
+	}
+	seen := make(map[netip.Addr]bool)
+	for _, addr := range expandEdges(addrs) {
+		if !seen[addr] {
+			seen[addr] = true
+			e.edges = append(e.edges, &edge{addr: addr, latency: probeTimeout})
+		}
+	}
+	if len(e.edges) == 0 {
+		return nil
+	}
+	go e.probeLoop()
+	return e
+}
+
+func expandEdges(addrs []string) []netip.Addr {
+	var result []netip.Addr
+	for _, s := range addrs {
+		sampled, err := SampleAddrs(s, maxPrefixEdges)
+		if err != nil {
+			log.Warnln("Invalid CDN IP: %s", s)
+			continue
+		}
+		result = append(result, sampled...)
+	}
+	return result
+}
+
+// SampleAddrs expands an IP or CIDR, sampling at most maxHosts distinct random
+// addresses from large prefixes.
+func SampleAddrs(cidr string, maxHosts int) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(cidr); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits < 31 && 1<<hostBits <= maxHosts {
+		var addrs []netip.Addr
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			addrs = append(addrs, addr)
+		}
+		return addrs, nil
+	}
+	seen := make(map[netip.Addr]bool, maxHosts)
+	var addrs []netip.Addr
+	for len(addrs) < maxHosts {
+		if addr := randomAddr(prefix); !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// randomAddr picks an address in prefix, avoiding the network address.
+func randomAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		if rand.Intn(2) == 1 {
+			b[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	if addr == prefix.Addr() {
+		addr = addr.Next()
+	}
+	return addr
+}
+
+// Addrs returns every candidate address.
+func (e *Edges) Addrs() []netip.Addr {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	addrs := make([]netip.Addr, 0, len(e.edges))
+	for _, edge := range e.edges {
+		addrs = append(addrs, edge.addr)
+	}
+	return addrs
+}
+
+// Best returns the best address of each family, the better one first.
+func (e *Edges) Best() []netip.Addr {
+	return e.bestExcept(nil)
+}
+
+// bestExcept is Best without the addresses in skip, it returns nil when none is left.
+func (e *Edges) bestExcept(skip map[netip.Addr]bool) []netip.Addr {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var best4, best6 *edge
+	for _, edge := range e.edges {
+		if skip[edge.addr] {
+			continue
+		}
+		best := &best6
+		if edge.addr.Is4() {
+			best = &best4
+		}
+		if *best == nil || edge.score() < (*best).score() {
+			*best = edge
+		}
+	}
+	var addrs []netip.Addr
+	switch {
+	case best4 == nil && best6 == nil:
+	case best4 == nil:
+		addrs = append(addrs, best6.addr)
+	case best6 == nil:
+		addrs = append(addrs, best4.addr)
+	case best6.score() < best4.score():
+		addrs = append(addrs, best6.addr, best4.addr)
+	default:
+		addrs = append(addrs, best4.addr, best6.addr)
+	}
+	return addrs
+}
+
+func (e *Edges) report(addr netip.Addr, latency time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, edge := range e.edges {
+		if edge.addr != addr {
+			continue
+		}
+		edge.attempts = edge.attempts*failureDecay + 1
+		edge.failures *= failureDecay
+		if !ok {
+			edge.failures++
+		} else if edge.attempts == 1 || edge.latency == probeTimeout {
+			edge.latency = latency
+		} else {
+			edge.latency = (edge.latency*7 + latency*3) / 10
+		}
+		return
+	}
+}
+
+type edgeAttemptKey struct{}
+
+// edgeAttempt goes with the context of a handshake: NetDialContext skips the
+// edges that already failed and records the one it used.
+type edgeAttempt struct {
+	used  netip.Addr
+	tried map[netip.Addr]bool
+}
+
+// NetDialContext returns a websocket NetDialContext that ignores the address
+// and races the best IPv4 and IPv6 edges with dial.
+func (e *Edges) NetDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		type result struct {
+			conn net.Conn
+			addr netip.Addr
+			err  error
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		attempt, _ := ctx.Value(edgeAttemptKey{}).(*edgeAttempt)
+		var addrs []netip.Addr
+		if attempt != nil {
+			addrs = e.bestExcept(attempt.tried)
+		}
+		if len(addrs) == 0 {
+			// Every edge failed already, start over.
+			addrs = e.Best()
+		}
+		results := make(chan result, len(addrs))
+		failed := make(chan struct{}, len(addrs))
+		for i, addr := range addrs {
+			go func(i int, addr netip.Addr) {
+				if i > 0 {
+					// Give the better family a head start.
+					select {
+					case <-time.After(happyEyeballsDelay):
+					case <-failed:
+					case <-ctx.Done():
+						results <- result{err: ctx.Err()}
+						return
+					}
+				}
+				start := time.Now()
+				conn, err := dial(ctx, network, net.JoinHostPort(addr.String(), strconv.Itoa(e.port)))
+				if err != nil {
+					if ctx.Err() == nil {
+						e.report(addr, time.Since(start), false)
+					}
+					failed <- struct{}{}
+				}
+				results <- result{conn, addr, err}
+			}(i, addr)
+		}
+
+		var err error
+		for range addrs {
+			r := <-results
+			if r.err != nil {
+				err = errors.Join(err, r.err)
+				if attempt != nil && r.addr.IsValid() {
+					attempt.tried[r.addr] = true
+				}
+				continue
+			}
+			if attempt != nil {
+				attempt.used = r.addr
+			}
+			cancel()
+			// Close the connection of the slower family if it also succeeds.
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.conn != nil {
+						_ = r.conn.Close()
+					}
+				}
+			}(len(addrs) - 1)
+			return r.conn, nil
+		}
+		return nil, err
+	}
+}
+
+// Handshake dials url with d, whose NetDialContext must come from e, and
+// retries on the next best edge when the websocket handshake fails.
+func (e *Edges) Handshake(d *websocket.Dialer, url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	var (
+		conn *websocket.Conn
+		resp *http.Response
+		err  error
+	)
+	attempt := &edgeAttempt{tried: make(map[netip.Addr]bool)}
+	ctx := context.WithValue(context.Background(), edgeAttemptKey{}, attempt)
+	for i := 0; i < handshakeAttempts; i++ {
+		attempt.used = netip.Addr{}
+		start := time.Now()
+		conn, resp, err = d.DialContext(ctx, url, header)
+		// Any HTTP response means the edge works, even when the origin refuses.
+		if err == nil || resp != nil {
+			if attempt.used.IsValid() {
+				e.report(attempt.used, time.Since(start), true)
+			}
+			return conn, resp, err
+		}
+		if attempt.used.IsValid() {
+			log.Debugln("[EDGE] handshake via %s failed: %v", attempt.used, err)
+			e.report(attempt.used, 0, false)
+			attempt.tried[attempt.used] = true
+		}
+	}
+	return conn, resp, err
+}
+
+func (e *Edges) probeLoop() {
+	for {
+		e.probe()
+		time.Sleep(e.interval)
+	}
+}
+
+// probe runs a websocket handshake through every edge.
+func (e *Edges) probe() {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probeConcurrency)
+	for _, addr := range e.Addrs() {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr netip.Addr) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d := &websocket.Dialer{
+				Proxy:            http.ProxyFromEnvironment,
+				HandshakeTimeout: probeTimeout,
+				TLSClientConfig:  e.tls,
+				NetDialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), strconv.Itoa(e.port)))
+				},
+			}
+			start := time.Now()
+			conn, resp, err := d.Dial(e.url, e.header)
+			if resp != nil && resp.Body != nil {
+				_ = resp.Body.Close()
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+			ok := err == nil || resp != nil
+			if !ok {
+				log.Debugln("[EDGE] probe %s failed: %v", addr, err)
+			}
+			e.report(addr, time.Since(start), ok)
+		}(addr)
+	}
+	wg.Wait()
+
+	best := e.Best()[0]
+	e.mu.Lock()
+	changed := best != e.best
+	e.best = best
+	e.mu.Unlock()
+	if changed {
+		log.Infoln("Best CDN IP: %s (%s)", best, e.summary(best))
+	}
+}
+
+func (e *Edges) summary(addr netip.Addr) string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, edge := range e.edges {
+		if edge.addr == addr {
+			rate := 0.0
+			if edge.attempts > 0 {
+				rate = edge.failures / edge.attempts
+			}
+			return edge.latency.Round(time.Millisecond).String() + ", " +
+				strconv.Itoa(int(rate*100)) + "% failed"
+		}
+	}
+	return ""
+}
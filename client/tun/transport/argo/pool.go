@@ -0,0 +1,172 @@
+package argo
+
+import (
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/metrics"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	adaptInterval = time.Second
+	// rateDecay is applied to the tracked dial rate every adaptInterval, so
+	// that the pool shrinks slowly after a burst.
+	rateDecay = 0.9
+	// maxPoolDials is the number of pool connections dialed at once.
+	maxPoolDials = 16
+	// fill waits from minFillBackoff, doubling up to maxFillBackoff, after
+	// consecutive failed dials.
+	minFillBackoff = 500 * time.Millisecond
+	maxFillBackoff = 30 * time.Second
+)
+
+func (p *Params) adaptive() bool {
+	return p.MaxPoolSize > 0
+}
+
+// PoolStats is a snapshot of the pool activity since start.
+type PoolStats struct {
+	Size      int32
+	Target    int32
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	// DialLatency is the moving average of the websocket handshakes.
+	DialLatency time.Duration
+}
+
+// poolStats are exported as metrics labelled with the pool name.
+type poolStats struct {
+	hits      *metrics.Value
+	misses    *metrics.Value
+	evictions *metrics.Value
+	size      *metrics.Value
+	target    *metrics.Value
+	latency   *metrics.Value // milliseconds
+
+	mu          sync.Mutex
+	dialLatency time.Duration
+}
+
+// newPoolStats only registers the metrics of real pools.
+func newPoolStats(name string, pooled bool) *poolStats {
+	if !pooled {
+		return &poolStats{
+			hits:      &metrics.Value{},
+			misses:    &metrics.Value{},
+			evictions: &metrics.Value{},
+			size:      &metrics.Value{},
+			target:    &metrics.Value{},
+			latency:   &metrics.Value{},
+		}
+	}
+	return &poolStats{
+		hits:      metrics.Counter("cftun_pool_hits_total", "pool", name),
+		misses:    metrics.Counter("cftun_pool_misses_total", "pool", name),
+		evictions: metrics.Counter("cftun_pool_evictions_total", "pool", name),
+		size:      metrics.Gauge("cftun_pool_size", "pool", name),
+		target:    metrics.Gauge("cftun_pool_target", "pool", name),
+		latency:   metrics.Gauge("cftun_pool_dial_latency_ms", "pool", name),
+	}
+}
+
+func (s *poolStats) observe(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dialLatency == 0 {
+		s.dialLatency = latency
+	} else {
+		s.dialLatency = (s.dialLatency*7 + latency*3) / 10
+	}
+	s.latency.Set(s.dialLatency.Milliseconds())
+}
+
+func (w *Websocket) Stats() PoolStats {
+	w.stats.mu.Lock()
+	latency := w.stats.dialLatency
+	w.stats.mu.Unlock()
+	return PoolStats{
+		Size:        w.connCount.Load(),
+		Target:      w.size(),
+		Hits:        w.stats.hits.Load(),
+		Misses:      w.stats.misses.Load(),
+		Evictions:   w.stats.evictions.Load(),
+		DialLatency: latency,
+	}
+}
+
+// adaptLoop sizes the pool to the recent dial rate: it keeps about a second
+// of dials ready, plus the misses of the last second, within the bounds. The
+// rate follows bursts at once and decays by rateDecay every second.
+func (w *Websocket) adaptLoop() {
+	w.stats.target.Set(int64(w.target.Load()))
+	w.fill()
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+	var rate float64
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case <-ticker.C:
+		}
+		dials, misses := w.dials.Swap(0), w.missed.Swap(0)
+		rate = math.Max(float64(dials), rate*rateDecay)
+		target := int32(math.Ceil(rate)) + int32(misses)
+		target = max(w.params.MinPoolSize, min(w.params.MaxPoolSize, target))
+		if old := w.target.Swap(target); old != target {
+			log.Debugln("[POOL] %s target %d -> %d, %d dials and %d misses in the last second.", w.params.Name, old, target, dials, misses)
+			w.stats.target.Set(int64(target))
+		}
+		w.trim()
+		w.fill()
+	}
+}
+
+// fill dials in the background until the pool reaches its target. A failed
+// dial waits for the next Dial or adaptInterval, and for the backoff.
+func (w *Websocket) fill() {
+	if time.Now().UnixNano() < w.backoffUntil.Load() {
+		return
+	}
+	for {
+		dialing := w.dialing.Load()
+		if dialing >= maxPoolDials || w.connCount.Load()+dialing >= w.target.Load() {
+			return
+		}
+		if w.dialing.CompareAndSwap(dialing, dialing+1) {
+			go func() {
+				ok := w.addConn()
+				w.dialing.Add(-1)
+				if ok {
+					w.fill()
+				} else {
+					w.backoff()
+				}
+			}()
+		}
+	}
+}
+
+// backoff delays the next fill after a failed dial.
+func (w *Websocket) backoff() {
+	failures := w.fillFailures.Add(1)
+	delay := min(minFillBackoff<<min(failures-1, 6), maxFillBackoff)
+	w.backoffUntil.Store(time.Now().Add(delay).UnixNano())
+	log.Debugln("[POOL] %s dial failed %d times in a row, next fill in %s.", w.params.Name, failures, delay)
+}
+
+// trim closes the pooled connections above the target, the oldest first.
+func (w *Websocket) trim() {
+	for w.connCount.Load() > w.target.Load() {
+		select {
+		case conn := <-w.connPool:
+			w.stats.size.Set(int64(w.connCount.Add(-1)))
+			w.stats.evictions.Inc()
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
@@ -2,16 +2,24 @@ package client
 
 import (
 	"fmt"
+	"github.com/fmnx/cftun/client/tun/proxy"
 	"github.com/fmnx/cftun/client/tun/transport/argo"
 	"github.com/fmnx/cftun/log"
 	"github.com/gorilla/websocket"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 )
 
 type Websocket struct {
+	keepalive *argo.Keepalive
+	// pool serves tunnels with pool-size, their destination is sent in-band.
+	pool     *proxy.Argo
+	network  string
+	remote   string
+	edges    *argo.Edges
 	wsDialer *websocket.Dialer
 	url      string
 	headers  http.Header
@@ -20,22 +28,25 @@ type Websocket struct {
 func NewWebsocket(config *Config, tunnel *Tunnel) *Websocket {
 	host := strings.Split(tunnel.Url, "/")[0]
 	wsDialer := &websocket.Dialer{
-		TLSClientConfig: nil,
+		TLSClientConfig: config.tlsConfig(tunnel.TLS),
 		Proxy:           http.ProxyFromEnvironment,
 	}
-	dial := net.Dial
+	netDialer := &net.Dialer{}
+	var localIP net.IP
 	// 绑定监听地址对应的网卡出口
 	if !strings.Contains(tunnel.Listen, "0.0.0.0") && !strings.Contains(tunnel.Listen, "127.0.0.1") {
-		localIP, _, _ := net.SplitHostPort(tunnel.Listen)
+		host, _, _ := net.SplitHostPort(tunnel.Listen)
+		localIP = net.ParseIP(host)
 		localAddr := &net.TCPAddr{
-			IP:   net.ParseIP(localIP),
+			IP:   localIP,
 			Port: 0,
 		}
-		dial = (&net.Dialer{
+		netDialer = &net.Dialer{
 			LocalAddr: localAddr,
 			Timeout:   5 * time.Second,
-		}).Dial
+		}
 	}
+	dial := netDialer.Dial
 
 	wsDialer.NetDial = func(network, addr string) (net.Conn, error) {
 		// 连接指定的 IP 地址而不是解析域名
@@ -44,23 +55,85 @@ func NewWebsocket(config *Config, tunnel *Tunnel) *Websocket {
 		}
 		return dial(network, addr)
 	}
+	edges := config.edges(tunnel.Url, tunnel.AuthKey, tunnel)
+	if edges != nil {
+		wsDialer.NetDialContext = edges.NetDialContext(netDialer.DialContext)
+	}
 
 	headers := make(http.Header)
 	headers.Set("Host", host)
 	headers.Set("User-Agent", "DEV")
-	headers.Set("Forward-Dest", tunnel.Remote)
-	headers.Set("Forward-Proto", tunnel.Protocol)
+	addHeaders(headers, config.extraHeaders(tunnel))
+	// A stock cloudflared origin relays the stream to its own ingress service.
+	if tunnel.Mode != TunnelModeCloudflared {
+		headers.Set("Forward-Dest", tunnel.Remote)
+		headers.Set("Forward-Proto", tunnel.Protocol)
+		if tunnel.AuthKey != "" {
+			headers.Set("Forward-Key", tunnel.AuthKey)
+		}
+	}
 
 	return &Websocket{
+		pool:     newTunnelPool(config, tunnel, localIP),
+		network:  tunnel.Protocol,
+		remote:   tunnel.Remote,
+		edges:    edges,
 		wsDialer: wsDialer,
 		headers:  headers,
 		url:      fmt.Sprintf("%s://%s", config.getScheme(), tunnel.Url),
+
+		keepalive: config.Keepalive,
 	}
 
 }
 
+// newTunnelPool returns nil unless the tunnel asks for a pool that it can use.
+func newTunnelPool(config *Config, tunnel *Tunnel, localIP net.IP) *proxy.Argo {
+	if tunnel.PoolSize <= 0 {
+		return nil
+	}
+	if tunnel.Mode == TunnelModeCloudflared {
+		log.Warnln("Tunnel %s: cloudflared mode does not support pool-size.", tunnel.Listen)
+		return nil
+	}
+	// The in-band header only carries IP destinations.
+	if _, err := netip.ParseAddrPort(tunnel.Remote); err != nil {
+		log.Warnln("Tunnel %s: pool-size needs an IP remote, not %s.", tunnel.Listen, tunnel.Remote)
+		return nil
+	}
+	params := config.argoParams(tunnel.Url, tunnel.AuthKey, tunnel)
+	params.Name = "tunnel " + tunnel.Listen
+	params.PoolSize = tunnel.PoolSize
+	params.LocalIP = localIP
+	if tunnel.MaxIdleAge != 0 {
+		params.MaxIdleAge = tunnel.MaxIdleAge
+	}
+	pool := proxy.NewArgo(params)
+	if tunnel.WarmUp == TunnelWarmUpEager {
+		go pool.Warmup()
+	}
+	return pool
+}
+
 func (w *Websocket) createWebsocketStream() (net.Conn, error) {
-	wsConn, resp, err := w.wsDialer.Dial(w.url, w.headers)
+	if w.pool != nil {
+		conn, err := w.pool.DialAddress(w.network, w.remote, nil)
+		if err != nil {
+			log.Errorln(err.Error())
+			return nil, err
+		}
+		return conn, nil
+	}
+	var (
+		wsConn *websocket.Conn
+		resp   *http.Response
+		err    error
+	)
+	if w.edges != nil {
+		wsConn, resp, err = w.edges.Handshake(w.wsDialer, w.url, w.headers)
+	} else {
+		wsConn, resp, err = w.wsDialer.Dial(w.url, w.headers)
+	}
 
 	if resp != nil && resp.Body != nil {
 		_ = resp.Body.Close()
@@ -71,6 +144,6 @@ func (w *Websocket) createWebsocketStream() (net.Conn, error) {
 		return nil, err
 	}
 
-	return &argo.GorillaConn{Conn: wsConn}, nil
+	return argo.NewGorillaConn(wsConn, w.keepalive), nil
 
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// commands are dispatched on the first argument, before the global flags are parsed.
+var commands = map[string]func(args []string) error{
+	"warp":  warpCommand,
+	"usage": usageCommand,
+	"scan":  scanCommand,
+}
+
+func isCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	_, ok := commands[os.Args[1]]
+	return ok
+}
+
+func runCommand() {
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/client"
+	"github.com/spf13/pflag"
+	"os"
+	"strings"
+	"time"
+)
+
+func scanCommand(args []string) error {
+	var cfgFile, cidrFile string
+	var save, asJSON bool
+	scan := &client.Scan{}
+	fs := pflag.NewFlagSet("scan", pflag.ContinueOnError)
+	fs.StringVarP(&cfgFile, "config", "c", "", "")
+	fs.StringSliceVar(&scan.CIDRs, "cidr", nil, "")
+	fs.StringVar(&cidrFile, "file", "", "")
+	fs.IntSliceVar(&scan.Ports, "port", nil, "")
+	fs.StringVar(&scan.Url, "url", "", "")
+	fs.StringVar(&scan.Scheme, "scheme", "", "")
+	fs.StringVar(&scan.AuthKey, "auth-key", "", "")
+	fs.IntVar(&scan.Timeout, "timeout", 0, "")
+	fs.IntVar(&scan.Concurrency, "concurrency", 0, "")
+	fs.IntVar(&scan.Rate, "rate", 0, "")
+	fs.IntVar(&scan.MaxHosts, "max-hosts", 0, "")
+	fs.IntVar(&scan.Top, "top", 10, "")
+	fs.StringVar(&scan.SpeedUrl, "speed-url", "", "")
+	fs.IntVar(&scan.SpeedDuration, "speed-duration", 0, "")
+	fs.BoolVar(&save, "save", false, "")
+	fs.BoolVar(&asJSON, "json", false, "")
+	fs.Usage = func() {
+		fmt.Println("Usage: cftun scan [flags]")
+		fmt.Println("Rank Cloudflare anycast IPs by TCP connect, TLS handshake and websocket upgrade to the tunnel hostname.")
+		fmt.Println("Flags:")
+		fmt.Printf("  -c,--config\t\tRead url, cdn-port, scheme, auth-key, tls, headers and access from the client section of this config file.\n")
+		fmt.Printf("  --cidr\t\tPrefixes or addresses to scan, repeatable.(default: Cloudflare IPv4 ranges)\n")
+		fmt.Printf("  --file\t\tFile of prefixes or addresses to scan, one per line.\n")
+		fmt.Printf("  --port\t\tPorts to scan, repeatable.(default: cdn-port or 443)\n")
+		fmt.Printf("  --url\t\t\tTunnel hostname, with path if any.(default: global-url)\n")
+		fmt.Printf("  --scheme\t\tws or wss.(default: by port)\n")
+		fmt.Printf("  --auth-key\t\tKey sent in Forward-Key.\n")
+		fmt.Printf("  --timeout\t\tTimeout of each step in milliseconds.(default: 2000)\n")
+		fmt.Printf("  --concurrency\t\tAddresses probed in parallel.(default: 32)\n")
+		fmt.Printf("  --rate\t\tNew connections per second, 0 for no limit.(default: 0)\n")
+		fmt.Printf("  --max-hosts\t\tAddresses sampled per prefix.(default: 16)\n")
+		fmt.Printf("  --top\t\t\tNumber of results to print.(default: 10)\n")
+		fmt.Printf("  --speed-url\t\tDownload this URL through each result to measure throughput,\n")
+		fmt.Printf("  \t\t\te.g. https://speed.cloudflare.com/__down?bytes=50000000\n")
+		fmt.Printf("  --speed-duration\tSeconds of each download.(default: 5)\n")
+		fmt.Printf("  --save\t\tWrite the best IP into cdn-ip of the config file.\n")
+		fmt.Printf("  --json\t\tPrint results as JSON.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	if cfgFile != "" {
+		rawConfig, err := parseConfig(cfgFile)
+		if err != nil {
+			return err
+		}
+		if c := rawConfig.Client; c != nil {
+			if scan.Url == "" {
+				scan.Url = c.GlobalUrl
+			}
+			if scan.Scheme == "" {
+				scan.Scheme = c.Scheme
+			}
+			if scan.AuthKey == "" {
+				scan.AuthKey = c.AuthKey
+			}
+			if len(scan.Ports) == 0 && c.CdnPort != 0 {
+				scan.Ports = []int{c.CdnPort}
+			}
+			scan.TLS = c.TLS
+			scan.Headers, scan.Access = c.Headers, c.Access
+		}
+	} else if save {
+		return errors.New("--save needs --config")
+	}
+	if cidrFile != "" {
+		cidrs, err := readCIDRFile(cidrFile)
+		if err != nil {
+			return err
+		}
+		scan.CIDRs = append(scan.CIDRs, cidrs...)
+	}
+	if scan.Url == "" {
+		fs.Usage()
+		return errors.New("missing --url")
+	}
+
+	results, err := client.ScanEdges(scan)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%-24s %10s %10s %10s %6s %6s %10s\n", "ADDRESS", "CONNECT", "TLS", "UPGRADE", "STATUS", "COLO", "SPEED")
+		for _, r := range results {
+			speed := "-"
+			if r.Speed > 0 {
+				speed = fmt.Sprintf("%.1fMbps", r.Speed*8/1e6)
+			}
+			colo := r.Colo
+			if colo == "" {
+				colo = "-"
+			}
+			fmt.Printf("%-24s %10s %10s %10s %6d %6s %10s\n", r.Address, r.Connect.Round(10*time.Microsecond),
+				r.TLS.Round(10*time.Microsecond), r.Upgrade.Round(10*time.Microsecond), r.Status, colo, speed)
+		}
+	}
+	if len(results) == 0 || results[0].Status != 101 {
+		return errors.New("no address accepted the websocket upgrade")
+	}
+	if save {
+		ip := results[0].Address[:strings.LastIndex(results[0].Address, ":")]
+		ip = strings.Trim(ip, "[]")
+		if err = saveCdnIp(cfgFile, ip); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved cdn-ip %s.\n", ip)
+	}
+	return nil
+}
+
+func readCIDRFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cidrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	return cidrs, scanner.Err()
+}
+
+// saveCdnIp sets client.cdn-ip in the config file. The other settings are kept,
+// but the file is reformatted.
+func saveCdnIp(name, ip string) error {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &raw); err != nil {
+		return err
+	}
+	section := make(map[string]json.RawMessage)
+	if c, ok := raw["client"]; ok {
+		if err = json.Unmarshal(c, &section); err != nil {
+			return err
+		}
+	}
+	if section["cdn-ip"], err = json.Marshal(ip); err != nil {
+		return err
+	}
+	if raw["client"], err = json.Marshal(section); err != nil {
+		return err
+	}
+	if buf, err = json.MarshalIndent(raw, "", "  "); err != nil {
+		return err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(buf, '\n'), info.Mode())
+}
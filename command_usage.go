@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/server"
+	"github.com/fmnx/cftun/server/cfd"
+	"github.com/spf13/pflag"
+	"os"
+	"sort"
+)
+
+func usageCommand(args []string) error {
+	var cfgFile, dir string
+	var asJSON bool
+	fs := pflag.NewFlagSet("usage", pflag.ContinueOnError)
+	fs.StringVarP(&cfgFile, "config", "c", "", "")
+	fs.StringVarP(&dir, "state-dir", "s", "", "")
+	fs.BoolVar(&asJSON, "json", false, "")
+	fs.Usage = func() {
+		fmt.Println("Usage: cftun usage [flags] [client...]")
+		fmt.Println("Flags:")
+		fmt.Printf("  -c,--config\tRead state-dir and quotas from the server section of this config file.\n")
+		fmt.Printf("  -s,--state-dir\tDirectory holding .usage.json.\n")
+		fmt.Printf("  --json\t\tPrint usage as JSON.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	var quotas *cfd.Quotas
+	if cfgFile != "" {
+		rawConfig, err := parseConfig(cfgFile)
+		if err != nil {
+			return err
+		}
+		if s := rawConfig.Server; s != nil {
+			if dir == "" {
+				dir = s.StateDir
+			}
+			quotas = s.Quotas
+		}
+	}
+	if err := server.SetStateDir(dir); err != nil {
+		return err
+	}
+	usage, err := server.LoadUsage()
+	if err != nil {
+		return err
+	}
+	// Apply the period resets the server would do with the current quotas.
+	if tracker := cfd.NewQuotaTracker(quotas); tracker != nil {
+		tracker.Restore(usage)
+		usage = tracker.Snapshot()
+	}
+	if fs.NArg() > 0 {
+		selected := make(map[string]*cfd.Usage)
+		for _, name := range fs.Args() {
+			if u, ok := usage[name]; ok {
+				selected[name] = u
+			}
+		}
+		usage = selected
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(usage)
+	}
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-24s %-10s %12s %12s %12s %12s\n", "CLIENT", "SINCE", "UP", "DOWN", "TOTAL", "QUOTA")
+	for _, name := range names {
+		u := usage[name]
+		quota := "-"
+		if u.Quota > 0 {
+			quota = formatBytes(u.Quota)
+		}
+		fmt.Printf("%-24s %-10s %12s %12s %12s %12s\n", name, u.Start.Format("2006-01-02"),
+			formatBytes(u.Up), formatBytes(u.Down), formatBytes(u.Total()), quota)
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/server"
+	"github.com/spf13/pflag"
+	"os"
+	"strings"
+	"time"
+)
+
+func warpCommand(args []string) error {
+	var cfgFile, dir, api string
+	var save, asJSON bool
+	scan := &server.WarpScan{}
+	fs := pflag.NewFlagSet("warp", pflag.ContinueOnError)
+	fs.StringVarP(&cfgFile, "config", "c", "", "")
+	fs.StringVarP(&dir, "state-dir", "s", "", "")
+	fs.StringVar(&api, "api", "", "")
+	fs.StringSliceVar(&scan.CIDRs, "cidr", nil, "")
+	fs.IntSliceVar(&scan.Ports, "port", nil, "")
+	fs.IntVar(&scan.Count, "count", 0, "")
+	fs.IntVar(&scan.Timeout, "timeout", 0, "")
+	fs.IntVar(&scan.Concurrency, "concurrency", 0, "")
+	fs.IntVar(&scan.MaxHosts, "max-hosts", 0, "")
+	fs.IntVar(&scan.Top, "top", 10, "")
+	fs.IntVar(&scan.Budget, "budget", 0, "")
+	fs.BoolVar(&save, "save", false, "")
+	fs.BoolVar(&asJSON, "json", false, "")
+	fs.Usage = func() {
+		fmt.Println("Usage: cftun warp <command> [flags]")
+		fmt.Println("Commands:")
+		fmt.Printf("  register\t\tRegister a new free account, replacing the saved one.\n")
+		fmt.Printf("  set-license <key>\tApply a WARP+ license key to the account.\n")
+		fmt.Printf("  rotate\t\tGenerate a new WireGuard key pair for the account.\n")
+		fmt.Printf("  show\t\t\tShow the account and check the tunnel end to end.\n")
+		fmt.Printf("  deregister\t\tDelete the account and the saved state.\n")
+		fmt.Printf("  scan\t\t\tRank endpoints by WireGuard handshake latency and loss.\n")
+		fmt.Println("Flags:")
+		fmt.Printf("  -c,--config\tRead state-dir and warp settings from the server section of this config file.\n")
+		fmt.Printf("  -s,--state-dir\tDirectory holding .warp.json.\n")
+		fmt.Printf("  --api\t\tCloudflare client API base URL.(default: \"https://api.cloudflareclient.com/v0a2223\")\n")
+		fmt.Println("Scan flags:")
+		fmt.Printf("  --cidr\t\tPrefixes or addresses to scan, repeatable.(default: Cloudflare WARP ranges)\n")
+		fmt.Printf("  --port\t\tPorts to scan, repeatable.(default: 2408,500,1701,4500)\n")
+		fmt.Printf("  --count\t\tHandshakes per endpoint.(default: 3)\n")
+		fmt.Printf("  --timeout\t\tHandshake timeout in milliseconds.(default: 1000)\n")
+		fmt.Printf("  --concurrency\tEndpoints probed in parallel.(default: 64)\n")
+		fmt.Printf("  --max-hosts\t\tAddresses sampled per prefix.(default: 256)\n")
+		fmt.Printf("  --top\t\tNumber of results to print.(default: 10)\n")
+		fmt.Printf("  --budget\t\tStop scanning after this many seconds.(default: no limit)\n")
+		fmt.Printf("  --save\t\tWrite the best endpoint into .warp.json.\n")
+		fmt.Printf("  --json\t\tPrint results as JSON.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command")
+	}
+
+	w := &server.Warp{Auto: true}
+	if cfgFile != "" {
+		rawConfig, err := parseConfig(cfgFile)
+		if err != nil {
+			return err
+		}
+		if s := rawConfig.Server; s != nil {
+			if dir == "" {
+				dir = s.StateDir
+			}
+			if s.Warp != nil {
+				w = s.Warp
+			}
+		}
+	}
+	if api != "" {
+		w.API = api
+	}
+	if err := server.SetStateDir(dir); err != nil {
+		return err
+	}
+	var loadErr error
+	if w.Auto {
+		loadErr = w.LoadState()
+	}
+
+	switch cmd := fs.Arg(0); cmd {
+	case "register":
+		if err := w.Register(); err != nil {
+			return err
+		}
+		if err := w.SaveState(); err != nil {
+			return err
+		}
+		fmt.Printf("Registered warp account %s.\n", w.ID)
+		return nil
+	case "show":
+		if loadErr != nil {
+			return loadErr
+		}
+		return showWarp(w)
+	case "scan":
+		if loadErr != nil {
+			return loadErr
+		}
+		return scanWarp(w, mergeWarpScan(scan, w.Scan, fs), save, asJSON)
+	}
+
+	if loadErr != nil {
+		return loadErr
+	}
+	switch cmd := fs.Arg(0); cmd {
+	case "set-license":
+		if fs.NArg() < 2 {
+			return errors.New("missing license key")
+		}
+		if err := w.SetLicense(fs.Arg(1)); err != nil {
+			return err
+		}
+		if err := w.SaveState(); err != nil {
+			return err
+		}
+		account, err := w.Account()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("License applied, account type: %s, warp+: %t.\n", account.AccountType, account.WarpPlus)
+	case "rotate":
+		if err := w.RotateKeys(); err != nil {
+			return err
+		}
+		if err := w.SaveState(); err != nil {
+			return err
+		}
+		fmt.Println("WireGuard keys rotated.")
+	case "deregister":
+		if err := w.Deregister(); err != nil {
+			return err
+		}
+		if err := w.RemoveState(); err != nil {
+			return err
+		}
+		fmt.Printf("Deregistered warp account %s.\n", w.ID)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+func showWarp(w *server.Warp) error {
+	fmt.Printf("ID: %s\nEndpoint: %s\nIPv4: %s\nIPv6: %s\n", w.ID, w.Endpoint, w.IPv4, w.IPv6)
+
+	account, err := w.Account()
+	if err != nil {
+		fmt.Printf("Account: %v\n", err)
+	} else {
+		fmt.Printf("AccountType: %s\nWarpPlus: %t\nLicense: %s\nQuota: %d\n",
+			account.AccountType, account.WarpPlus, account.License, account.Quota)
+	}
+
+	trace, err := w.Trace()
+	if err != nil {
+		fmt.Printf("Tunnel: %v\n", err)
+		return nil
+	}
+	for _, line := range strings.Split(trace, "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && (key == "ip" || key == "colo" || key == "warp") {
+			fmt.Printf("Tunnel %s: %s\n", key, value)
+		}
+	}
+	return nil
+}
+
+// mergeWarpScan fills the options not given on the command line from the config.
+func mergeWarpScan(flags, config *server.WarpScan, fs *pflag.FlagSet) *server.WarpScan {
+	if config == nil {
+		return flags
+	}
+	merged := *config
+	if fs.Changed("cidr") {
+		merged.CIDRs = flags.CIDRs
+	}
+	if fs.Changed("port") {
+		merged.Ports = flags.Ports
+	}
+	if fs.Changed("count") {
+		merged.Count = flags.Count
+	}
+	if fs.Changed("timeout") {
+		merged.Timeout = flags.Timeout
+	}
+	if fs.Changed("concurrency") {
+		merged.Concurrency = flags.Concurrency
+	}
+	if fs.Changed("max-hosts") {
+		merged.MaxHosts = flags.MaxHosts
+	}
+	if fs.Changed("budget") {
+		merged.Budget = flags.Budget
+	}
+	if fs.Changed("top") || merged.Top == 0 {
+		merged.Top = flags.Top
+	}
+	return &merged
+}
+
+func scanWarp(w *server.Warp, scan *server.WarpScan, save, asJSON bool) error {
+	results, err := w.ScanEndpoints(scan)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%-48s %10s %6s\n", "ENDPOINT", "RTT", "LOSS")
+		for _, r := range results {
+			fmt.Printf("%-48s %10s %5.0f%%\n", r.Endpoint, r.RTT.Round(10*time.Microsecond), r.Loss*100)
+		}
+	}
+	if len(results) == 0 {
+		return errors.New("no endpoint answered the handshake")
+	}
+	if save {
+		w.Endpoint = results[0].Endpoint
+		if err = w.SaveState(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved endpoint %s.\n", w.Endpoint)
+	}
+	return nil
+}
@@ -59,6 +59,11 @@ func Fatalln(format string, v ...any) {
 	log.Fatalf(format, v...)
 }
 
+// RegisterExitHandler runs handler before Fatalln exits.
+func RegisterExitHandler(handler func()) {
+	log.RegisterExitHandler(handler)
+}
+
 func print(data Event) {
 	if data.LogLevel < level {
 		return
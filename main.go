@@ -53,9 +53,14 @@ var (
 	showVersion        bool
 	quickData          = &server.QuickData{}
 	tunName            string
+	stateDir           string
+	srv                *server.Config
 )
 
 func init() {
+	if isCommand() {
+		return
+	}
 	pflag.StringVarP(&configFile, "config", "c", "./config.json", "")
 	pflag.StringVarP(&token, "token", "t", "", "")
 	pflag.BoolVarP(&isQuick, "quick", "q", false, "")
@@ -63,6 +68,7 @@ func init() {
 	pflag.BoolVarP(&proxy6, "proxy6", "6", false, "")
 	pflag.IntVarP(&port, "port", "p", 51280, "")
 	pflag.BoolVarP(&showVersion, "version", "v", false, "")
+	pflag.StringVarP(&stateDir, "state-dir", "s", "", "")
 
 	pflag.Usage = func() {
 		fmt.Println("Usage:")
@@ -72,12 +78,21 @@ func init() {
 		fmt.Printf("  -4,--proxy4\tUse the WARP proxy for IPv4 traffic; Ignored when using a configuration file.\n")
 		fmt.Printf("  -6,--proxy6\tUse the WARP proxy for IPv4 traffic; Ignored when using a configuration file.\n")
 		fmt.Printf("  -p,--port\tSet the local port for WARP; Ignored when using a configuration file.\n")
+		fmt.Printf("  -s,--state-dir\tDirectory for persistent quick/warp state. Overrides \"state-dir\" in the config file.\n")
 		fmt.Printf("  -v,--version\tDisplay the current binary file version.\n")
+		fmt.Println("Commands:")
+		fmt.Printf("  warp		Manage the WARP account, see \"cftun warp --help\".\n")
+		fmt.Printf("  usage		Show the traffic quota usage of each client, see \"cftun usage --help\".\n")
+		fmt.Printf("  scan		Rank Cloudflare anycast IPs for cdn-ip, see \"cftun scan --help\".\n")
 	}
 	pflag.Parse()
 }
 
 func main() {
+	if isCommand() {
+		runCommand()
+		return
+	}
 	bInfo := server.GetBuildInfo(BuildType, CloudflaredVersion)
 	if showVersion {
 		printVersion(bInfo)
@@ -98,16 +113,17 @@ func main() {
 		} else if token == "quick" {
 			isQuick = true
 		}
-		srv := &server.Config{
-			Token:  token,
-			HaConn: 4,
-			Warp:   warp,
+		srv = &server.Config{
+			Token:    token,
+			HaConn:   4,
+			Warp:     warp,
+			StateDir: stateDir,
 		}
 		go srv.Run(bInfo, quickData)
 	} else {
 		rawConfig, err := parseConfig(configFile)
 		if err != nil {
-			log.Fatalln("Failed to parse config file: ", err.Error())
+			log.Fatalln("Failed to parse config file: %v", err)
 		}
 
 		c := rawConfig.Client
@@ -129,6 +145,10 @@ func main() {
 			if s.Token == "quick" {
 				isQuick = true
 			}
+			if stateDir != "" {
+				s.StateDir = stateDir
+			}
+			srv = s
 			go s.Run(bInfo, quickData)
 		}
 
@@ -142,6 +162,8 @@ func main() {
 			if isQuick {
 				quickData.Save()
 			}
+			srv.Stop()
+			client.CleanupTransparent()
 			if tunName != "" {
 				client.DeleteTunDevice(tunName)
 			}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Value is a counter or gauge exported in the Prometheus text format.
+type Value struct {
+	v atomic.Int64
+}
+
+func (v *Value) Add(delta int64) {
+	v.v.Add(delta)
+}
+
+func (v *Value) Inc() {
+	v.v.Add(1)
+}
+
+func (v *Value) Dec() {
+	v.v.Add(-1)
+}
+
+func (v *Value) Set(value int64) {
+	v.v.Store(value)
+}
+
+func (v *Value) Load() int64 {
+	return v.v.Load()
+}
+
+type family struct {
+	kind   string
+	values map[string]*Value
+}
+
+var (
+	mu       sync.Mutex
+	families = make(map[string]*family)
+)
+
+// Counter returns the counter for name and the label pairs, creating it on first use.
+func Counter(name string, labels ...string) *Value {
+	return get("counter", name, labels)
+}
+
+// Gauge returns the gauge for name and the label pairs, creating it on first use.
+func Gauge(name string, labels ...string) *Value {
+	return get("gauge", name, labels)
+}
+
+func get(kind, name string, labels []string) *Value {
+	key := formatLabels(labels)
+	mu.Lock()
+	defer mu.Unlock()
+	f, ok := families[name]
+	if !ok {
+		f = &family{kind: kind, values: make(map[string]*Value)}
+		families[name] = f
+	}
+	v, ok := f.values[key]
+	if !ok {
+		v = &Value{}
+		f.values[key] = v
+	}
+	return v
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func WriteTo(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := families[name]
+		_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			_, _ = fmt.Fprintf(w, "%s%s %d\n", name, key, f.values[key].Load())
+		}
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
+
+// Serve exposes /metrics on addr.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	log.Infoln("Metrics listen on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorln("Metrics server error: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package cfd
+
+import (
+	"context"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	relayBufferSize = 32 << 10
+	// Every stream relays through two buffers, one per direction.
+	streamBufferCost     = 2 * relayBufferSize
+	defaultQueueTimeout  = 5 * time.Second
+	admissionRejectQueue = "queue full"
+	admissionRejectWait  = "queue timeout"
+)
+
+// Admission bounds the streams served at once across all clients and tunnel
+// connections, so that a burst of streams cannot exhaust the memory.
+type Admission struct {
+	MaxStreams int `yaml:"max-streams" json:"max-streams"`
+	// MaxBufferMemory caps the relay buffers in use, in bytes. Every stream holds 64 KiB.
+	MaxBufferMemory int64 `yaml:"max-buffer-memory" json:"max-buffer-memory"`
+	// Queue is how many streams may wait for a free slot, extra streams are rejected at once.
+	Queue        int `yaml:"queue" json:"queue"`
+	QueueTimeout int `yaml:"queue-timeout" json:"queue-timeout"` // milliseconds
+
+	mu      sync.Mutex
+	active  int
+	queued  int
+	waiters []chan struct{}
+	once    sync.Once
+}
+
+func (a *Admission) init() {
+	a.once.Do(func() {
+		metrics.Gauge("cftun_admission_max_streams").Set(int64(a.capacity()))
+		metrics.Gauge("cftun_admission_max_buffer_bytes").Set(a.MaxBufferMemory)
+	})
+}
+
+// capacity is the number of streams allowed by both MaxStreams and
+// MaxBufferMemory, 0 when unlimited.
+func (a *Admission) capacity() int {
+	capacity := a.MaxStreams
+	if a.MaxBufferMemory > 0 {
+		byMemory := max(int(a.MaxBufferMemory/streamBufferCost), 1)
+		if capacity <= 0 || byMemory < capacity {
+			capacity = byMemory
+		}
+	}
+	return capacity
+}
+
+// Acquire takes a stream slot, waiting in the queue when none is free. A
+// non-empty reason means the stream is refused.
+func (a *Admission) Acquire(ctx context.Context) string {
+	if a == nil {
+		return ""
+	}
+	a.init()
+	capacity := a.capacity()
+
+	a.mu.Lock()
+	if capacity <= 0 || a.active < capacity {
+		a.active++
+		a.mu.Unlock()
+		metrics.Gauge("cftun_admission_active_streams").Inc()
+		return ""
+	}
+	if a.queued >= a.Queue {
+		defer a.mu.Unlock()
+		return a.reject(admissionRejectQueue)
+	}
+	ready := make(chan struct{})
+	a.waiters = append(a.waiters, ready)
+	a.queued++
+	a.mu.Unlock()
+	metrics.Gauge("cftun_admission_queued_streams").Inc()
+	defer metrics.Gauge("cftun_admission_queued_streams").Dec()
+
+	timeout := time.Duration(a.QueueTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		// Release handed its slot over.
+		return ""
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, w := range a.waiters {
+		if w == ready {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			a.queued--
+			return a.reject(admissionRejectWait)
+		}
+	}
+	// The slot was handed over while timing out, give it back.
+	a.release()
+	return a.reject(admissionRejectWait)
+}
+
+// reject must be called with a.mu held.
+func (a *Admission) reject(reason string) string {
+	metrics.Counter("cftun_admission_rejected_total", "reason", reason).Inc()
+	log.Warnln("[ADMISSION] rejected new stream, %s (%d active, %d queued).", reason, a.active, a.queued)
+	return "server busy, " + reason
+}
+
+// Release frees a slot taken by Acquire, handing it to the oldest waiter if any.
+func (a *Admission) Release() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release()
+}
+
+func (a *Admission) release() {
+	if len(a.waiters) > 0 {
+		close(a.waiters[0])
+		a.waiters = a.waiters[1:]
+		a.queued--
+		return
+	}
+	a.active--
+	metrics.Gauge("cftun_admission_active_streams").Dec()
+}
+
+var relayBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+func getRelayBuffer() *[]byte {
+	metrics.Gauge("cftun_relay_buffer_bytes").Add(relayBufferSize)
+	return relayBuffers.Get().(*[]byte)
+}
+
+func putRelayBuffer(buf *[]byte) {
+	metrics.Gauge("cftun_relay_buffer_bytes").Add(-relayBufferSize)
+	relayBuffers.Put(buf)
+}
@@ -7,21 +7,40 @@ import (
 	"github.com/fmnx/cftun/log"
 	"github.com/quic-go/quic-go"
 	"net"
+	"strings"
 	"time"
 )
 
 type DialFunc func(network string, address string) (net.Conn, error)
 
+// ChainFunc dials through another cftun server, hops is the hop count to send along.
+type ChainFunc func(network, address string, hops int) (net.Conn, error)
+
 type Proxy struct {
 	DialFunc DialFunc
-	Proxy4   bool
-	Proxy6   bool
+	// Direct dials traffic that is not sent through DialFunc, net.Dial if nil.
+	Direct DialFunc
+	// Chain takes all traffic when set.
+	Chain  ChainFunc
+	Proxy4 bool
+	Proxy6 bool
+}
+
+// dialHops dials address for a stream that has already passed hops servers.
+func (d *Proxy) dialHops(network, address string, hops int) (net.Conn, error) {
+	if d.Chain != nil {
+		return d.Chain(network, address, hops+1)
+	}
+	return d.Dial(network, address)
 }
 
 func (d *Proxy) Dial(network, address string) (net.Conn, error) {
-	if isIPv6 := address[0] == '['; (isIPv6 && d.Proxy6) || (!isIPv6 && d.Proxy4) {
+	if isIPv6 := address[0] == '['; d.DialFunc != nil && ((isIPv6 && d.Proxy6) || (!isIPv6 && d.Proxy4)) {
 		return d.DialFunc(network, address)
 	}
+	if d.Direct != nil {
+		return d.Direct(network, address)
+	}
 	return net.Dial(network, address)
 }
 
@@ -32,7 +51,7 @@ type QuicConnection struct {
 	rpcTimeout  time.Duration
 	gracePeriod time.Duration
 
-	proxy *Proxy
+	handler *Handler
 }
 
 func NewTunnelConnection(
@@ -40,14 +59,14 @@ func NewTunnelConnection(
 	connIndex uint8,
 	rpcTimeout time.Duration,
 	gracePeriod time.Duration,
-	proxy *Proxy,
+	handler *Handler,
 ) (*QuicConnection, error) {
 	return &QuicConnection{
 		conn:        conn,
 		connIndex:   connIndex,
 		rpcTimeout:  rpcTimeout,
 		gracePeriod: gracePeriod,
-		proxy:       proxy,
+		handler:     handler,
 	}, nil
 }
 
@@ -104,50 +123,105 @@ func (q *QuicConnection) handleQuicStream(quicStream quic.Stream) {
 
 	noCloseStream := &nopCloserReadWriter{ReadWriteCloser: stream}
 
-	n, err := noCloseStream.Read(make([]byte, 6)) //ignore 6 byte
-	if err != nil || n != 6 {
-		println(err.Error())
+	signature, err := readSignature(noCloseStream)
+	if err != nil {
+		return
+	}
+	if signature != dataStreamProtocolSignature {
+		log.Debugln("Ignored stream with unknown signature %x.", signature)
 		return
 	}
 
 	requestServerStream := &RequestServerStream{ReadWriteCloser: noCloseStream}
 
-	var remoteConn net.Conn
-	network, address, err := requestServerStream.Accept()
+	request, err := requestServerStream.ReadConnectRequestData()
 	if err != nil {
 		return
 	}
-	if network != "" && address != "" {
-		remoteConn, err = q.DialWithRetry(network, address, 3)
-		if err != nil {
-			return
-		}
-	}
 
-	wsCtx, cancel := context.WithCancel(ctx)
-	wsConn := NewConn(wsCtx, requestServerStream)
-	defer wsConn.Close()
-	defer cancel()
+	q.handler.serveStream(ctx, requestServerStream, request)
+}
 
-	q.handleConn(ctx, cancel, wsConn, remoteConn)
+// inbandWait is how long an untagged stream has to send an in-band packet
+// header before it goes to the default destination, which may speak first.
+const inbandWait = time.Second
 
+type firstRead struct {
+	data []byte
+	err  error
 }
 
-func (q *QuicConnection) handleConn(ctx context.Context, cancel context.CancelFunc, wsConn *Conn, remoteConn net.Conn) {
-	buf := make([]byte, 32<<10)
+// replayConn returns the first message read by sniffInband before the rest
+// of the stream.
+type replayConn struct {
+	relayConn
+	first   chan firstRead
+	read    bool
+	pending firstRead
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if !c.read {
+		c.read, c.pending = true, <-c.first
+	}
+	if c.pending.err != nil {
+		return 0, c.pending.err
+	}
+	if len(c.pending.data) > 0 {
+		n := copy(b, c.pending.data)
+		c.pending.data = c.pending.data[n:]
+		return n, nil
+	}
+	return c.relayConn.Read(b)
+}
+
+// sniffInband waits up to inbandWait for the first message of conn and
+// reports whether it is an in-band packet header. The message is replayed
+// either way, also when it arrives later.
+func sniffInband(conn relayConn) (relayConn, bool) {
+	c := &replayConn{relayConn: conn, first: make(chan firstRead, 1)}
+	go func() {
+		buf := make([]byte, relayBufferSize)
+		nr, err := conn.Read(buf)
+		c.first <- firstRead{buf[:nr], err}
+	}()
+
+	timer := time.NewTimer(inbandWait)
+	defer timer.Stop()
+	select {
+	case c.pending = <-c.first:
+		c.read = true
+		if c.pending.err != nil {
+			return c, false
+		}
+		packet, err := Decode(c.pending.data)
+		return c, err == nil && packet.valid()
+	case <-timer.C:
+		return c, false
+	}
+}
+
+// handleConn relays wsConn and remoteConn, dialed to network and address. A nil
+// remoteConn is dialed from the packet header in the first message.
+func handleConn(ctx context.Context, cancel context.CancelFunc, wsConn relayConn, remoteConn net.Conn, network, address string, control *streamControl) {
+	bufp := getRelayBuffer()
+	defer putRelayBuffer(bufp)
+	buf := *bufp
 
 	if remoteConn == nil {
 		nr, err := wsConn.Read(buf)
 		if err != nil {
 			return
 		}
+		if !control.up(ctx, nr) {
+			return
+		}
 		packet, err := Decode(buf[:nr])
 		if err != nil {
 			return
 		}
-		network := packet.protocol()
-		address := packet.address()
-		remoteConn, err = q.DialWithRetry(network, address, 3)
+		network, address = packet.protocol(), packet.address()
+		remoteConn, err = control.dial(network, address)
 		if err != nil {
 			return
 		}
@@ -161,7 +235,9 @@ func (q *QuicConnection) handleConn(ctx context.Context, cancel context.CancelFu
 		}
 	}
 
-	go handleRemoteConn(ctx, cancel, remoteConn, wsConn)
+	go handleRemoteConn(ctx, cancel, remoteConn, network, address, wsConn, control)
+	// Unblock handleRemoteConn when the client goes away.
+	defer remoteConn.Close()
 
 	for {
 		select {
@@ -172,6 +248,9 @@ func (q *QuicConnection) handleConn(ctx context.Context, cancel context.CancelFu
 			if err != nil {
 				return
 			}
+			if !control.up(ctx, nr) {
+				return
+			}
 
 			//if nr == 2 && buf[0] == 137 && buf[1] == 0 {
 			//	println("recv client ping msg")
@@ -192,7 +271,7 @@ func (q *QuicConnection) handleConn(ctx context.Context, cancel context.CancelFu
 
 }
 
-func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn net.Conn, wsConn *Conn) {
+func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn net.Conn, network, address string, wsConn relayConn, control *streamControl) {
 	var err error
 
 	defer func() {
@@ -205,10 +284,11 @@ func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn
 		//}
 	}()
 
+	// Whatever dialed it, direct, chained or through WARP, a UDP flow ends when idle.
 	setReadDeadline := func(c net.Conn) error { return nil }
-	if _, ok := remoteConn.(*net.UDPConn); ok {
+	if strings.HasPrefix(network, "udp") {
 		udpTimeout := 60 * time.Second
-		if remoteConn.RemoteAddr().(*net.UDPAddr).Port == 53 { // DNS query
+		if _, port, _ := net.SplitHostPort(address); port == "53" { // DNS query
 			udpTimeout = 1 * time.Second
 		}
 		setReadDeadline = func(c net.Conn) error {
@@ -216,7 +296,9 @@ func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn
 		}
 	}
 
-	buf := make([]byte, 32<<10)
+	bufp := getRelayBuffer()
+	defer putRelayBuffer(bufp)
+	buf := *bufp
 	for {
 		select {
 		case <-ctx.Done():
@@ -231,6 +313,10 @@ func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn
 			if err != nil {
 				return
 			}
+			if !control.down(ctx, nr) {
+				err = errors.New("quota exhausted")
+				return
+			}
 			nw, err = wsConn.Write(buf[:nr])
 			if err != nil {
 				return
@@ -247,14 +333,14 @@ func (q *QuicConnection) Close() {
 	_ = q.conn.CloseWithError(0, "")
 }
 
-func (q *QuicConnection) DialWithRetry(network, address string, maxRetries int) (net.Conn, error) {
+func (d *Proxy) DialWithRetry(network, address string, hops, maxRetries int) (net.Conn, error) {
 	var (
 		conn net.Conn
 		err  error
 	)
 
 	for i := 0; i < maxRetries; i++ {
-		conn, err = q.proxy.Dial(network, address)
+		conn, err = d.dialHops(network, address, hops)
 		if err == nil {
 			return conn, nil
 		}
@@ -0,0 +1,126 @@
+package cfd
+
+import (
+	"context"
+	"github.com/fmnx/cftun/log"
+	"io"
+	"net"
+	"net/http"
+)
+
+// requestStream answers a connect request and then carries the websocket,
+// over a QUIC stream from the edge or a hijacked HTTP connection.
+type requestStream interface {
+	io.ReadWriter
+	Accept(request *ConnectRequest) error
+	Reject(status int, reason string) error
+	WriteConnectResponseData(metadata ...Metadata) error
+}
+
+// Handler applies the virtual servers, policies and outbounds to every stream,
+// whatever it came from.
+type Handler struct {
+	servers  []*VirtualServer
+	fallback *VirtualServer
+	// Keepalive of the websocket streams, the defaults when nil.
+	Keepalive *Keepalive
+}
+
+// NewHandler serves streams through servers, fallback takes the streams that
+// match none of them.
+func NewHandler(fallback *VirtualServer, servers []*VirtualServer) *Handler {
+	return &Handler{
+		servers:  servers,
+		fallback: fallback,
+	}
+}
+
+func (h *Handler) serveStream(ctx context.Context, stream requestStream, request *ConnectRequest) {
+	server := route(h.servers, h.fallback, request)
+	policy := server.Policy
+
+	identity, ok := policy.identify(request)
+	if !ok {
+		log.Warnln("Rejected stream from %s: invalid auth key.", request.ClientIP())
+		_ = stream.Reject(http.StatusForbidden, "invalid auth key")
+		return
+	}
+	if request.Type != ConnectionTypeTCP && request.WebsocketKey() == "" {
+		_ = policy.serveHTTP(stream, request, identity)
+		return
+	}
+	network, address := server.destination(request)
+	network, address, status, reason := policy.resolve(identity, network, address)
+	if reason == "" && request.Type == ConnectionTypeTCP && (network != "tcp" || address == "") {
+		status, reason = http.StatusBadRequest, "tcp streams need a tcp destination"
+	}
+	if reason != "" {
+		log.Warnln("Rejected stream from %s to %s: %s.", identity, request.Address(), reason)
+		_ = stream.Reject(status, reason)
+		return
+	}
+	hops := request.Hops()
+	if maxHops := policy.maxHops(); hops >= maxHops {
+		log.Warnln("Rejected stream from %s: %d hops reached, chain loop?", identity, hops)
+		_ = stream.Reject(http.StatusLoopDetected, "too many hops")
+		return
+	}
+
+	control, status, reason := policy.admit(ctx, identity)
+	if reason != "" {
+		_ = stream.Reject(status, reason)
+		return
+	}
+	defer control.release()
+	control.proxy, control.hops = server.Proxy, hops
+
+	if err := stream.Accept(request); err != nil {
+		return
+	}
+
+	wsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var conn relayConn = rawConn{stream}
+	if request.Type != ConnectionTypeTCP {
+		wsConn := NewConn(h.Keepalive.context(wsCtx), stream)
+		defer wsConn.Close()
+		conn = wsConn
+	}
+	if server.sniffs(request) {
+		var inband bool
+		if conn, inband = sniffInband(conn); inband {
+			network, address = "", ""
+		}
+	}
+
+	var remoteConn net.Conn
+	if network != "" && address != "" {
+		var err error
+		remoteConn, err = control.dial(network, address)
+		if err != nil {
+			return
+		}
+	}
+
+	handleConn(ctx, cancel, conn, remoteConn, network, address, control)
+}
+
+// relayConn is the client side of a stream, websocket framed or raw.
+type relayConn interface {
+	io.ReadWriter
+	Close()
+}
+
+type rawConn struct {
+	io.ReadWriter
+}
+
+func (rawConn) Close() {}
+
+// admission is shared by all virtual servers.
+func (h *Handler) admission() *Admission {
+	if h.fallback.Policy == nil {
+		return nil
+	}
+	return h.fallback.Policy.Admission
+}
@@ -0,0 +1,262 @@
+package cfd
+
+import (
+	"context"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit is a set of limits, a zero field means unlimited.
+type Limit struct {
+	Up               int64   `yaml:"up" json:"up"`     // bytes per second, client -> origin
+	Down             int64   `yaml:"down" json:"down"` // bytes per second, origin -> client
+	StreamsPerSecond float64 `yaml:"streams-per-second" json:"streams-per-second"`
+	StreamBurst      int     `yaml:"stream-burst" json:"stream-burst"`
+	MaxStreams       int32   `yaml:"max-streams" json:"max-streams"`
+}
+
+// Limits applies Global across all clients, plus Clients[identity] or
+// Default to each client identity.
+type Limits struct {
+	Global  *Limit            `yaml:"global" json:"global"`
+	Default *Limit            `yaml:"default" json:"default"`
+	Clients map[string]*Limit `yaml:"clients" json:"clients"`
+}
+
+// limiterIdleTTL is how long the state of a client without streams is kept.
+const limiterIdleTTL = 10 * time.Minute
+
+type Limiter struct {
+	limits    *Limits
+	global    *limitState
+	mu        sync.Mutex
+	clients   map[string]*limitState
+	lastSweep time.Time
+}
+
+func NewLimiter(limits *Limits) *Limiter {
+	if limits == nil {
+		return nil
+	}
+	return &Limiter{
+		limits:    limits,
+		global:    newLimitState(limits.Global),
+		clients:   make(map[string]*limitState),
+		lastSweep: time.Now(),
+	}
+}
+
+type limitState struct {
+	limit   *Limit
+	up      *tokenBucket
+	down    *tokenBucket
+	streams *tokenBucket
+	active  atomic.Int32
+	// lastUsed is guarded by Limiter.mu.
+	lastUsed time.Time
+}
+
+func newLimitState(limit *Limit) *limitState {
+	if limit == nil {
+		limit = &Limit{}
+	}
+	ls := &limitState{limit: limit}
+	if limit.Up > 0 {
+		ls.up = newTokenBucket(float64(limit.Up), float64(limit.Up))
+	}
+	if limit.Down > 0 {
+		ls.down = newTokenBucket(float64(limit.Down), float64(limit.Down))
+	}
+	if limit.StreamsPerSecond > 0 {
+		burst := float64(limit.StreamBurst)
+		if burst < 1 {
+			burst = max(limit.StreamsPerSecond, 1)
+		}
+		ls.streams = newTokenBucket(limit.StreamsPerSecond, burst)
+	}
+	return ls
+}
+
+func (l *Limiter) client(identity string) *limitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterIdleTTL {
+		l.sweep(now)
+	}
+	ls, ok := l.clients[identity]
+	if !ok {
+		limit := l.limits.Clients[identity]
+		if limit == nil {
+			limit = l.limits.Default
+		}
+		ls = newLimitState(limit)
+		l.clients[identity] = ls
+	}
+	ls.lastUsed = now
+	return ls
+}
+
+// sweep drops the clients idle for limiterIdleTTL, with l.mu held. Their
+// buckets have refilled by then, a new state is the same.
+func (l *Limiter) sweep(now time.Time) {
+	for identity, ls := range l.clients {
+		if ls.active.Load() == 0 && now.Sub(ls.lastUsed) > limiterIdleTTL {
+			delete(l.clients, identity)
+		}
+	}
+	l.lastSweep = now
+}
+
+// label names identity in the metrics: the clients without their own limits
+// share "default", so that every connecting IP does not add a series.
+func (l *Limiter) label(identity string) string {
+	if _, ok := l.limits.Clients[identity]; ok {
+		return identity
+	}
+	return "default"
+}
+
+// Admit checks the stream rate and concurrency caps for a new stream of
+// identity. On success the returned StreamLimit shapes its traffic and must
+// be released when the stream ends.
+func (l *Limiter) Admit(identity string) (*StreamLimit, string) {
+	if l == nil {
+		return nil, ""
+	}
+	states := []*limitState{l.client(identity), l.global}
+	// A rejected stream must not use up a slot or a token of any state.
+	for i, ls := range states {
+		if active := ls.active.Add(1); ls.limit.MaxStreams > 0 && active > ls.limit.MaxStreams {
+			for _, admitted := range states[:i+1] {
+				admitted.active.Add(-1)
+			}
+			l.hit(identity, "max-streams")
+			return nil, "concurrent stream limit exceeded"
+		}
+	}
+	for i, ls := range states {
+		if ls.streams != nil && !ls.streams.take(1) {
+			for _, admitted := range states[:i] {
+				if admitted.streams != nil {
+					admitted.streams.refund(1)
+				}
+			}
+			for _, admitted := range states {
+				admitted.active.Add(-1)
+			}
+			l.hit(identity, "stream-rate")
+			return nil, "stream rate limit exceeded"
+		}
+	}
+	return &StreamLimit{label: l.label(identity), states: states}, ""
+}
+
+func (l *Limiter) hit(identity, reason string) {
+	metrics.Counter("cftun_limit_rejected_total", "identity", l.label(identity), "reason", reason).Inc()
+	log.Warnln("[LIMIT] %s: rejected new stream, %s.", identity, reason)
+}
+
+// StreamLimit shapes the traffic of one admitted stream.
+type StreamLimit struct {
+	label    string
+	states   []*limitState
+	released atomic.Bool
+}
+
+func (s *StreamLimit) Release() {
+	if s == nil || s.released.Swap(true) {
+		return
+	}
+	for _, ls := range s.states {
+		ls.active.Add(-1)
+	}
+}
+
+// WaitUp blocks until n bytes may be sent from the client to the origin.
+func (s *StreamLimit) WaitUp(ctx context.Context, n int) {
+	if s == nil {
+		return
+	}
+	for _, ls := range s.states {
+		if ls.up != nil && ls.up.wait(ctx, n) {
+			metrics.Counter("cftun_limit_throttled_total", "identity", s.label, "direction", "up").Inc()
+		}
+	}
+}
+
+// WaitDown blocks until n bytes may be sent from the origin to the client.
+func (s *StreamLimit) WaitDown(ctx context.Context, n int) {
+	if s == nil {
+		return
+	}
+	for _, ls := range s.states {
+		if ls.down != nil && ls.down.wait(ctx, n) {
+			metrics.Counter("cftun_limit_throttled_total", "identity", s.label, "direction", "down").Inc()
+		}
+	}
+}
+
+// tokenBucket refills at rate tokens per second up to burst. Waiters may
+// drive it into debt so that writes larger than the burst still pass.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *tokenBucket) take(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refund returns n tokens taken by a stream that was rejected after all.
+func (b *tokenBucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+n)
+}
+
+// wait consumes n tokens and sleeps off any debt, it reports whether it had to wait.
+func (b *tokenBucket) wait(ctx context.Context, n int) bool {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+	if debt <= 0 {
+		return false
+	}
+	timer := time.NewTimer(time.Duration(debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return true
+}
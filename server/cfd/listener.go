@@ -0,0 +1,116 @@
+package cfd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPHandler serves the websocket upgrades that the edge would otherwise
+// deliver, so that the server can run behind any reverse proxy or CDN. The
+// client IP is taken from realIPHeader when set, e.g. X-Forwarded-For behind
+// nginx, and from the connection otherwise.
+func (h *Handler) HTTPHandler(realIPHeader string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := httpConnectRequest(r, realIPHeader)
+		stream := &httpStream{w: w}
+		h.serveStream(r.Context(), stream, request)
+		if stream.conn != nil {
+			_ = stream.conn.Close()
+		}
+	})
+}
+
+func httpConnectRequest(r *http.Request, realIPHeader string) *ConnectRequest {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	request := &ConnectRequest{
+		Dest: fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.RequestURI()),
+	}
+	for key, values := range r.Header {
+		// The edge sets it, here only the connection can tell.
+		if strings.EqualFold(key, "Cf-Connecting-Ip") {
+			continue
+		}
+		request.Metadata = append(request.Metadata, Metadata{"HttpHeader:" + key, strings.Join(values, ",")})
+	}
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if realIPHeader != "" {
+		if value := r.Header.Get(realIPHeader); value != "" {
+			// Proxies append the address they saw to X-Forwarded-For.
+			forwarded := strings.Split(value, ",")
+			clientIP = strings.TrimSpace(forwarded[len(forwarded)-1])
+		}
+	}
+	request.Metadata = append(request.Metadata, Metadata{"HttpHeader:Cf-Connecting-Ip", clientIP})
+	return request
+}
+
+// httpStream answers over net/http until the upgrade and then carries the
+// websocket over the hijacked connection.
+type httpStream struct {
+	w    http.ResponseWriter
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func (s *httpStream) Accept(request *ConnectRequest) error {
+	conn, rw, err := http.NewResponseController(s.w).Hijack()
+	if err != nil {
+		return err
+	}
+	s.conn, s.rw = conn, rw
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		websocketAccept(request.WebsocketKey()))
+	return err
+}
+
+func (s *httpStream) Reject(status int, reason string) error {
+	return s.WriteConnectResponseData(
+		Metadata{"HttpStatus", strconv.Itoa(status)},
+		Metadata{"HttpHeader:Cftun-Reason", reason},
+	)
+}
+
+func (s *httpStream) WriteConnectResponseData(metadata ...Metadata) error {
+	status := http.StatusOK
+	for _, m := range metadata {
+		if m.Key == "HttpStatus" {
+			status, _ = strconv.Atoi(m.Val)
+		} else if name, ok := strings.CutPrefix(m.Key, "HttpHeader:"); ok {
+			s.w.Header().Set(name, m.Val)
+		}
+	}
+	s.w.WriteHeader(status)
+	return nil
+}
+
+func (s *httpStream) Read(p []byte) (int, error) {
+	if s.rw == nil {
+		return 0, errors.New("websocket not accepted")
+	}
+	// The reader may hold bytes that arrived with the upgrade request.
+	return s.rw.Read(p)
+}
+
+func (s *httpStream) SetReadDeadline(t time.Time) error {
+	if s.conn == nil {
+		return errors.New("websocket not accepted")
+	}
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *httpStream) Write(p []byte) (int, error) {
+	if s.conn == nil {
+		return s.w.Write(p)
+	}
+	return s.conn.Write(p)
+}
@@ -39,6 +39,11 @@ func (p *Packet) address() string {
 	return fmt.Sprintf("[%s]:%d", p.DestIP.String(), p.DestPort)
 }
 
+// valid reports whether p names a destination the relay can dial.
+func (p *Packet) valid() bool {
+	return p.protocol() != "" && (p.Protocol == ICMP || p.DestPort != 0)
+}
+
 func Decode(data []byte) (*Packet, error) {
 	if len(data) < 2 {
 		return nil, fmt.Errorf("data too short")
@@ -67,7 +72,7 @@ func Decode(data []byte) (*Packet, error) {
 		return nil, fmt.Errorf("unsupported IP version: %d", p.IPVersion)
 	}
 
-	if len(data) < offset+4 {
+	if len(data) < offset+2 {
 		return nil, fmt.Errorf("missing port fields")
 	}
 	p.DestPort = binary.BigEndian.Uint16(data[offset : offset+2])
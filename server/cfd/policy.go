@@ -0,0 +1,104 @@
+package cfd
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+)
+
+// Policy holds the rules applied to every stream, shared by all tunnel connections.
+type Policy struct {
+	// AuthKeys maps a client name to the key it sends in Forward-Key. When
+	// set, streams without a known key are rejected.
+	AuthKeys  map[string]string
+	Limiter   *Limiter
+	Quotas    *QuotaTracker
+	Admission *Admission
+	// MaxHops rejects streams that already passed this many chained servers.
+	MaxHops int
+	// Services are published by name, see resolve.
+	Services map[string]*Service
+	// DisableRaw rejects streams that name their destination instead of a service.
+	DisableRaw bool
+}
+
+const defaultMaxHops = 8
+
+func (p *Policy) maxHops() int {
+	if p == nil || p.MaxHops <= 0 {
+		return defaultMaxHops
+	}
+	return p.MaxHops
+}
+
+// identify names the client of request: the auth key's name when keys are
+// configured, otherwise the connecting IP reported by Cloudflare.
+func (p *Policy) identify(request *ConnectRequest) (string, bool) {
+	if p == nil || len(p.AuthKeys) == 0 {
+		if ip := request.ClientIP(); ip != "" {
+			return ip, true
+		}
+		return "anonymous", true
+	}
+	key := request.AuthKey()
+	for name, k := range p.AuthKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// admit applies the admission control, limits and quotas to a new stream of
+// identity. A non-empty reason means the stream is refused with status.
+func (p *Policy) admit(ctx context.Context, identity string) (*streamControl, int, string) {
+	if p == nil {
+		return &streamControl{}, 0, ""
+	}
+	if reason := p.Admission.Acquire(ctx); reason != "" {
+		return nil, http.StatusServiceUnavailable, reason
+	}
+	quota, reason := p.Quotas.Admit(identity)
+	if reason == "" {
+		var limit *StreamLimit
+		if limit, reason = p.Limiter.Admit(identity); reason == "" {
+			return &streamControl{admission: p.Admission, limit: limit, quota: quota}, 0, ""
+		}
+	}
+	p.Admission.Release()
+	return nil, http.StatusTooManyRequests, reason
+}
+
+// streamControl dials, shapes and accounts the traffic relayed for one stream.
+type streamControl struct {
+	admission *Admission
+	limit     *StreamLimit
+	quota     *StreamQuota
+	proxy     *Proxy
+	hops      int
+}
+
+func (s *streamControl) dial(network, address string) (net.Conn, error) {
+	return s.proxy.DialWithRetry(network, address, s.hops, 3)
+}
+
+func (s *streamControl) release() {
+	s.quota.Release()
+	s.limit.Release()
+	s.admission.Release()
+}
+
+// up is called before n bytes from the client are relayed, it reports whether
+// the stream may go on.
+func (s *streamControl) up(ctx context.Context, n int) bool {
+	s.limit.WaitUp(ctx, n)
+	return s.quota.Up(n)
+}
+
+// down is called before n bytes to the client are relayed, it reports whether
+// the stream may go on.
+func (s *streamControl) down(ctx context.Context, n int) bool {
+	s.limit.WaitDown(ctx, n)
+	return s.quota.Down(n)
+}
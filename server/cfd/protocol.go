@@ -18,6 +18,12 @@ const (
 	protocolVersionLength = 2
 )
 
+func readSignature(stream io.Reader) (protocolSignature, error) {
+	var signature protocolSignature
+	_, err := io.ReadFull(stream, signature[:])
+	return signature, err
+}
+
 func readVersion(stream io.Reader) (string, error) {
 	version := make([]byte, 2)
 	_, err := stream.Read(version)
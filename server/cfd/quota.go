@@ -0,0 +1,239 @@
+package cfd
+
+import (
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+
+	// A stream adds its traffic to the usage of its client every
+	// quotaFlushBytes or quotaFlushInterval, and when it ends.
+	quotaFlushBytes    = 1 << 20
+	quotaFlushInterval = time.Second
+)
+
+// Quota caps the bytes a client may transfer, in both directions, per period.
+type Quota struct {
+	Bytes  int64  `yaml:"bytes" json:"bytes"`
+	Period string `yaml:"period" json:"period"` // daily or monthly, default monthly
+	// ResetDay is the day of month a monthly quota resets on, 1 by default.
+	ResetDay int `yaml:"reset-day" json:"reset-day"`
+}
+
+// Quotas applies Clients[identity] or Default to each client identity.
+type Quotas struct {
+	Default *Quota            `yaml:"default" json:"default"`
+	Clients map[string]*Quota `yaml:"clients" json:"clients"`
+	// CutOff closes the open streams of a client as soon as its quota is exhausted,
+	// otherwise only new streams are refused.
+	CutOff bool `yaml:"cut-off" json:"cut-off"`
+}
+
+func (q *Quota) periodStart(now time.Time) time.Time {
+	y, m, d := now.Date()
+	if q.Period == QuotaDaily {
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	}
+	day := min(max(q.ResetDay, 1), 28)
+	start := time.Date(y, m, day, 0, 0, 0, 0, now.Location())
+	if start.After(now) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// Usage is the traffic of one client in the current period.
+type Usage struct {
+	Start time.Time `json:"start"`
+	Up    int64     `json:"up"`
+	Down  int64     `json:"down"`
+	Quota int64     `json:"quota"`
+}
+
+func (u *Usage) Total() int64 {
+	return u.Up + u.Down
+}
+
+func (u *Usage) Exhausted() bool {
+	return u.Quota > 0 && u.Total() >= u.Quota
+}
+
+type QuotaTracker struct {
+	quotas *Quotas
+	mu     sync.Mutex
+	usage  map[string]*Usage
+}
+
+func NewQuotaTracker(quotas *Quotas) *QuotaTracker {
+	if quotas == nil {
+		return nil
+	}
+	return &QuotaTracker{
+		quotas: quotas,
+		usage:  make(map[string]*Usage),
+	}
+}
+
+func (t *QuotaTracker) quota(identity string) *Quota {
+	if q, ok := t.quotas.Clients[identity]; ok {
+		return q
+	}
+	return t.quotas.Default
+}
+
+// current returns the usage of identity, reset if a new period has begun. It must
+// be called with t.mu held and returns nil for identities without a quota.
+func (t *QuotaTracker) current(identity string, now time.Time) *Usage {
+	q := t.quota(identity)
+	if q == nil {
+		return nil
+	}
+	start := q.periodStart(now)
+	u, ok := t.usage[identity]
+	if !ok {
+		u = &Usage{Start: start}
+		t.usage[identity] = u
+	} else if u.Start.Before(start) {
+		log.Debugln("[QUOTA] %s: period reset, used %d of %d bytes.", identity, u.Total(), u.Quota)
+		*u = Usage{Start: start}
+	}
+	u.Quota = q.Bytes
+	return u
+}
+
+// Admit refuses new streams of identity once its quota is exhausted.
+func (t *QuotaTracker) Admit(identity string) (*StreamQuota, string) {
+	if t == nil {
+		return nil, ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.current(identity, time.Now())
+	if u == nil {
+		return nil, ""
+	}
+	if u.Exhausted() {
+		metrics.Counter("cftun_quota_rejected_total", "identity", identity).Inc()
+		log.Warnln("[QUOTA] %s: rejected new stream, quota of %d bytes exhausted.", identity, u.Quota)
+		return nil, "traffic quota exhausted"
+	}
+	s := &StreamQuota{
+		tracker:  t,
+		identity: identity,
+		used:     metrics.Gauge("cftun_quota_used_bytes", "identity", identity),
+	}
+	s.lastFlush.Store(time.Now().UnixNano())
+	return s, ""
+}
+
+func (t *QuotaTracker) add(identity string, up, down int64, used *metrics.Value) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.current(identity, time.Now())
+	if u == nil {
+		return true
+	}
+	exhausted := u.Exhausted()
+	u.Up += up
+	u.Down += down
+	used.Set(u.Total())
+	if !exhausted && u.Exhausted() {
+		log.Warnln("[QUOTA] %s: quota of %d bytes exhausted.", identity, u.Quota)
+	}
+	return !u.Exhausted() || !t.quotas.CutOff
+}
+
+// Snapshot copies the usage of every client, resetting the ones whose period has ended.
+func (t *QuotaTracker) Snapshot() map[string]*Usage {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	snapshot := make(map[string]*Usage, len(t.usage))
+	for identity := range t.usage {
+		if u := t.current(identity, now); u != nil {
+			c := *u
+			snapshot[identity] = &c
+		}
+	}
+	return snapshot
+}
+
+// Restore loads previously saved usage, typically right after startup.
+func (t *QuotaTracker) Restore(usage map[string]*Usage) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for identity, u := range usage {
+		if u != nil && t.quota(identity) != nil {
+			c := *u
+			t.usage[identity] = &c
+		}
+	}
+}
+
+// StreamQuota accounts the traffic of one admitted stream.
+type StreamQuota struct {
+	tracker  *QuotaTracker
+	identity string
+	used     *metrics.Value
+
+	up, down  atomic.Int64
+	lastFlush atomic.Int64 // unix nanoseconds
+	cut       atomic.Bool
+}
+
+// Up accounts n bytes from the client, it reports whether the stream may go on.
+func (s *StreamQuota) Up(n int) bool {
+	if s == nil {
+		return true
+	}
+	s.up.Add(int64(n))
+	return s.maybeFlush()
+}
+
+// Down accounts n bytes to the client, it reports whether the stream may go on.
+func (s *StreamQuota) Down(n int) bool {
+	if s == nil {
+		return true
+	}
+	s.down.Add(int64(n))
+	return s.maybeFlush()
+}
+
+func (s *StreamQuota) maybeFlush() bool {
+	now := time.Now().UnixNano()
+	if s.up.Load()+s.down.Load() >= quotaFlushBytes || now-s.lastFlush.Load() >= int64(quotaFlushInterval) {
+		s.lastFlush.Store(now)
+		s.flush()
+	}
+	return !s.cut.Load()
+}
+
+func (s *StreamQuota) flush() {
+	up, down := s.up.Swap(0), s.down.Swap(0)
+	if up == 0 && down == 0 {
+		return
+	}
+	if !s.tracker.add(s.identity, up, down, s.used) {
+		s.cut.Store(true)
+	}
+}
+
+// Release accounts what is left when the stream ends.
+func (s *StreamQuota) Release() {
+	if s == nil {
+		return
+	}
+	s.flush()
+}
@@ -0,0 +1,107 @@
+package cfd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	servicePrefix = "svc:"
+	// ServicesPath lists the services a client may use, e.g. GET https://<tunnel>/cftun/services.
+	ServicesPath = "/cftun/services"
+)
+
+// Service is a destination published under a name, clients ask for it with
+// Forward-Dest: svc:<name> instead of sending the address.
+type Service struct {
+	Address  string `yaml:"address" json:"address"`
+	Protocol string `yaml:"protocol" json:"protocol"` // tcp or udp, default tcp
+	// Clients are the identities allowed to use the service, everyone when empty.
+	Clients []string `yaml:"clients" json:"clients"`
+}
+
+func (s *Service) network() string {
+	if s.Protocol == "" {
+		return "tcp"
+	}
+	return s.Protocol
+}
+
+func (s *Service) allows(identity string) bool {
+	return len(s.Clients) == 0 || slices.Contains(s.Clients, identity)
+}
+
+// ServiceInfo is what a client learns about a service from discovery.
+type ServiceInfo struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+}
+
+// resolve maps the destination requested by identity to the one to dial. A
+// non-empty reason means the stream is refused with status.
+func (p *Policy) resolve(identity, network, address string) (string, string, int, string) {
+	name, ok := strings.CutPrefix(address, servicePrefix)
+	if !ok {
+		// An empty address means the destination follows in-band, which is raw as well.
+		if !p.allowRaw() {
+			return "", "", http.StatusForbidden, "raw destinations are disabled"
+		}
+		return network, address, 0, ""
+	}
+	var service *Service
+	if p != nil {
+		service = p.Services[name]
+	}
+	if service == nil || !service.allows(identity) {
+		// Do not tell unknown services apart from forbidden ones.
+		return "", "", http.StatusNotFound, "unknown service " + name
+	}
+	if network != "" && network != service.network() {
+		return "", "", http.StatusBadRequest, "service " + name + " is " + service.network()
+	}
+	return service.network(), service.Address, 0, ""
+}
+
+func (p *Policy) allowRaw() bool {
+	return p == nil || !p.DisableRaw
+}
+
+// services lists the services identity may use.
+func (p *Policy) services(identity string) []ServiceInfo {
+	infos := make([]ServiceInfo, 0)
+	if p == nil {
+		return infos
+	}
+	for name, service := range p.Services {
+		if service.allows(identity) {
+			infos = append(infos, ServiceInfo{Name: name, Protocol: service.network()})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// serveHTTP answers plain HTTP requests, which only the discovery endpoint handles.
+func (p *Policy) serveHTTP(rss requestStream, request *ConnectRequest, identity string) error {
+	u, err := url.Parse(request.Dest)
+	if err != nil || u.Path != ServicesPath {
+		return rss.Reject(http.StatusNotFound, "not found")
+	}
+	body, err := json.Marshal(p.services(identity))
+	if err != nil {
+		return err
+	}
+	err = rss.WriteConnectResponseData(
+		Metadata{"HttpStatus", "200"},
+		Metadata{"HttpHeader:Content-Type", "application/json"},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = rss.Write(body)
+	return err
+}
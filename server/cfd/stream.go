@@ -8,6 +8,8 @@ import (
 	"github.com/quic-go/quic-go"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,29 +24,46 @@ type RequestServerStream struct {
 	io.ReadWriteCloser
 }
 
-func (rss *RequestServerStream) Accept() (network, address string, err error) {
-	request, err := rss.ReadConnectRequestData()
-	if err != nil {
-		return
+func (rss *RequestServerStream) SetReadDeadline(t time.Time) error {
+	return setReadDeadline(rss.ReadWriteCloser, t)
+}
+
+// setReadDeadline sets the read deadline of r when it supports one.
+func setReadDeadline(r io.Reader, t time.Time) error {
+	if d, ok := r.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
 	}
-	k := sha1.New()
-	k.Write([]byte(request.WebsocketKey()))
-	k.Write([]byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-	wsAccept := base64.StdEncoding.EncodeToString(k.Sum(nil))
+	return errors.New("read deadline not supported")
+}
 
+// Accept answers the websocket upgrade of request, or acknowledges a TCP stream.
+func (rss *RequestServerStream) Accept(request *ConnectRequest) error {
+	if request.Type == ConnectionTypeTCP {
+		return rss.WriteConnectResponseData()
+	}
 	metadata := []Metadata{
 		{"HttpStatus", "101"},
 		{"HttpHeader:Connection", "Upgrade"},
-		{"HttpHeader:Sec-Websocket-Accept", wsAccept},
+		{"HttpHeader:Sec-Websocket-Accept", websocketAccept(request.WebsocketKey())},
 		{"HttpHeader:Upgrade", "websocket"},
 	}
 
-	err = rss.WriteConnectResponseData(metadata...)
+	return rss.WriteConnectResponseData(metadata...)
+}
 
-	if err == nil {
-		network, address = request.Network(), request.Address()
-	}
-	return
+func websocketAccept(key string) string {
+	k := sha1.New()
+	k.Write([]byte(key))
+	k.Write([]byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(k.Sum(nil))
+}
+
+// Reject answers request with an HTTP error status instead of upgrading.
+func (rss *RequestServerStream) Reject(status int, reason string) error {
+	return rss.WriteConnectResponseData(
+		Metadata{"HttpStatus", strconv.Itoa(status)},
+		Metadata{"HttpHeader:Cftun-Reason", reason},
+	)
 }
 
 func (rss *RequestServerStream) ReadConnectRequestData() (*ConnectRequest, error) {
@@ -83,6 +102,13 @@ func (rss *RequestServerStream) WriteConnectResponseData(metadata ...Metadata) e
 
 type ConnectionType uint16
 
+const (
+	ConnectionTypeHTTP ConnectionType = iota
+	ConnectionTypeWebsocket
+	// ConnectionTypeTCP carries raw TCP, e.g. from WARP routing, without websocket framing.
+	ConnectionTypeTCP
+)
+
 type Metadata struct {
 	Key string `capnp:"key"`
 	Val string `capnp:"val"`
@@ -94,31 +120,45 @@ type ConnectRequest struct {
 	Metadata []Metadata     `capnp:"metadata"`
 }
 
-func (r *ConnectRequest) WebsocketKey() string {
+// Header returns the value of the HTTP request header name.
+func (r *ConnectRequest) Header(name string) string {
+	key := "HttpHeader:" + name
 	for _, metadata := range r.Metadata {
-		if metadata.Key == "HttpHeader:Sec-Websocket-Key" {
+		if strings.EqualFold(metadata.Key, key) {
 			return metadata.Val
 		}
 	}
 	return ""
 }
 
+func (r *ConnectRequest) WebsocketKey() string {
+	return r.Header("Sec-Websocket-Key")
+}
+
+// ProtoInband is the Forward-Proto of the streams whose destination comes in
+// their first message, see Packet.
+const ProtoInband = "inband"
+
 func (r *ConnectRequest) Network() string {
-	for _, metadata := range r.Metadata {
-		if metadata.Key == "HttpHeader:Forward-Proto" {
-			return metadata.Val
-		}
-	}
-	return ""
+	return r.Header("Forward-Proto")
 }
 
 func (r *ConnectRequest) Address() string {
-	for _, metadata := range r.Metadata {
-		if metadata.Key == "HttpHeader:Forward-Dest" {
-			return metadata.Val
-		}
-	}
-	return ""
+	return r.Header("Forward-Dest")
+}
+
+func (r *ConnectRequest) AuthKey() string {
+	return r.Header("Forward-Key")
+}
+
+// Hops is the number of cftun servers the stream has already passed.
+func (r *ConnectRequest) Hops() int {
+	hops, _ := strconv.Atoi(r.Header("Forward-Hops"))
+	return max(hops, 0)
+}
+
+func (r *ConnectRequest) ClientIP() string {
+	return r.Header("Cf-Connecting-Ip")
 }
 
 type ConnectRequestProto struct{ capnp.Struct }
@@ -212,6 +252,10 @@ func (s *SafeStreamCloser) handleWriteError(err error) {
 	}
 }
 
+func (s *SafeStreamCloser) SetReadDeadline(t time.Time) error {
+	return s.stream.SetReadDeadline(t)
+}
+
 func (s *SafeStreamCloser) Close() error {
 	// Set this stream to a closing state.
 	s.closing.Store(true)
@@ -269,6 +313,10 @@ func (np *nopCloserReadWriter) Read(p []byte) (n int, err error) {
 	return
 }
 
+func (np *nopCloserReadWriter) SetReadDeadline(t time.Time) error {
+	return setReadDeadline(np.ReadWriteCloser, t)
+}
+
 func (np *nopCloserReadWriter) Close() error {
 	atomic.StoreUint32(&np.closed, 1)
 
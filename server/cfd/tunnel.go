@@ -18,7 +18,7 @@ type EdgeTunnelServer struct {
 	EdgeIPS      chan netip.AddrPort
 	EdgeBindAddr net.IP
 	NsResult     []string
-	Proxy        *Proxy
+	Handler      *Handler
 	ClientInfo   *ClientInfo
 	mu           sync.Mutex
 }
@@ -106,12 +106,21 @@ func (e *EdgeTunnelServer) serveQUIC(
 		initialPacketSize = 1232
 	}
 
+	maxIncomingStreams := int64(MaxIncomingStreams)
+	if admission := e.Handler.admission(); admission != nil {
+		// Let QUIC flow control hold back the edge instead of accepting streams
+		// that could only be rejected.
+		if capacity := admission.capacity(); capacity > 0 {
+			maxIncomingStreams = int64(capacity + admission.Queue)
+		}
+	}
+
 	quicConfig := &quic.Config{
 		HandshakeIdleTimeout:  HandshakeIdleTimeout,
 		MaxIdleTimeout:        MaxIdleTimeout,
 		KeepAlivePeriod:       MaxIdlePingPeriod,
-		MaxIncomingStreams:    MaxIncomingStreams,
-		MaxIncomingUniStreams: MaxIncomingStreams,
+		MaxIncomingStreams:    maxIncomingStreams,
+		MaxIncomingUniStreams: maxIncomingStreams,
 		EnableDatagrams:       true,
 		InitialPacketSize:     initialPacketSize,
 	}
@@ -134,7 +143,7 @@ func (e *EdgeTunnelServer) serveQUIC(
 		connIndex,
 		rpcTimeout,
 		gracePeriod,
-		e.Proxy,
+		e.Handler,
 	)
 	if err != nil {
 		log.Errorln("Failed to create new tunnel connection")
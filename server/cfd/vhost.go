@@ -0,0 +1,85 @@
+package cfd
+
+import (
+	"net/url"
+	"strings"
+)
+
+// VirtualServer is the profile for the streams sent to one hostname and path
+// prefix of the tunnel.
+type VirtualServer struct {
+	// Host is a hostname, "*.example.com" or empty for any hostname.
+	Host string
+	// Path is a prefix of the request path, empty for any path.
+	Path string
+	// Default is the destination, or svc:<name>, of streams without any Forward-* header.
+	Default         string
+	DefaultProtocol string
+	Proxy           *Proxy
+	Policy          *Policy
+}
+
+// score ranks how well v matches, -1 when it does not match at all.
+func (v *VirtualServer) score(host, path string) int {
+	score := 0
+	switch {
+	case v.Host == "":
+	case strings.EqualFold(v.Host, host):
+		score += 2
+	case strings.HasPrefix(v.Host, "*.") && strings.HasSuffix(strings.ToLower(host), strings.ToLower(v.Host[1:])):
+		score += 1
+	default:
+		return -1
+	}
+	prefix := strings.TrimSuffix(v.Path, "/")
+	if prefix != "" && path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return -1
+	}
+	// A longer path beats a more specific host.
+	return len(prefix)*4 + score
+}
+
+// destination is the network and address requested by a stream of v, both
+// empty when the client sends them in-band. Streams without any Forward-*
+// header, e.g. from stock cloudflared clients, go to Default.
+func (v *VirtualServer) destination(request *ConnectRequest) (string, string) {
+	network, address := request.Network(), request.Address()
+	if network == ProtoInband {
+		return "", ""
+	}
+	if network == "" && address == "" && v.Default != "" {
+		network, address = v.DefaultProtocol, v.Default
+		if network == "" && !strings.HasPrefix(address, servicePrefix) {
+			network = "tcp"
+		}
+	} else if address == "" && request.Type == ConnectionTypeTCP {
+		network, address = "tcp", request.Dest
+	}
+	return network, address
+}
+
+// sniffs reports whether a stream of v goes to Default only unless its first
+// message turns out to be an in-band packet header. Pooled streams of clients
+// older than the inband marker carry no Forward-* header either.
+func (v *VirtualServer) sniffs(request *ConnectRequest) bool {
+	return v.Default != "" && request.Type != ConnectionTypeTCP &&
+		request.Network() == "" && request.Address() == "" && v.Policy.allowRaw()
+}
+
+// route picks the virtual server for request, fallback when none matches.
+func route(servers []*VirtualServer, fallback *VirtualServer, request *ConnectRequest) *VirtualServer {
+	if len(servers) == 0 {
+		return fallback
+	}
+	var host, path string
+	if u, err := url.Parse(request.Dest); err == nil {
+		host, path = u.Hostname(), u.Path
+	}
+	best, bestScore := fallback, -1
+	for _, v := range servers {
+		if score := v.score(host, path); score > bestScore {
+			best, bestScore = v, score
+		}
+	}
+	return best
+}
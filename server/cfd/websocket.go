@@ -3,31 +3,62 @@ package cfd
 import (
 	"context"
 	"errors"
+	"github.com/fmnx/cftun/log"
 	gobwas "github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type PingPeriodContext string
 
 const (
-	defaultPongWait      = 60 * time.Second
-	defaultPingPeriod    = (defaultPongWait * 9) / 10
+	defaultPingPeriod    = 10 * time.Second
+	defaultPongWait      = 10 * time.Second
 	PingPeriodContextKey = PingPeriodContext("pingPeriod")
+	PongWaitContextKey   = PingPeriodContext("pongWait")
 )
 
+// Keepalive pings the clients' websockets every Interval seconds and closes the
+// ones that sent nothing for Interval+Timeout seconds.
+type Keepalive struct {
+	Interval int `yaml:"interval" json:"interval"`
+	Timeout  int `yaml:"timeout" json:"timeout"`
+}
+
+// context carries the keepalive settings to NewConn.
+func (k *Keepalive) context(ctx context.Context) context.Context {
+	if k == nil {
+		return ctx
+	}
+	if k.Interval > 0 {
+		ctx = context.WithValue(ctx, PingPeriodContextKey, time.Duration(k.Interval)*time.Second)
+	}
+	if k.Timeout > 0 {
+		ctx = context.WithValue(ctx, PongWaitContextKey, time.Duration(k.Timeout)*time.Second)
+	}
+	return ctx
+}
+
 type Conn struct {
 	rw        io.ReadWriter
 	writeLock sync.Mutex
 	done      bool
+
+	// lastSeen is the time of the last frame from the client, in unix nanoseconds.
+	lastSeen atomic.Int64
+	// keepalive is set once the client pings or answers a ping. Older clients
+	// do not read their pooled websockets, those are never timed out.
+	keepalive atomic.Bool
 }
 
 func NewConn(ctx context.Context, rw io.ReadWriter) *Conn {
 	c := &Conn{
 		rw: rw,
 	}
+	c.lastSeen.Store(time.Now().UnixNano())
 	go c.pinger(ctx)
 	return c
 }
@@ -41,6 +72,15 @@ func (c *Conn) pingPeriod(ctx context.Context) time.Duration {
 	return defaultPingPeriod
 }
 
+func (c *Conn) pongWait(ctx context.Context) time.Duration {
+	if val := ctx.Value(PongWaitContextKey); val != nil {
+		if wait, ok := val.(time.Duration); ok {
+			return wait
+		}
+	}
+	return defaultPongWait
+}
+
 func (c *Conn) ping() (bool, error) {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -53,25 +93,28 @@ func (c *Conn) ping() (bool, error) {
 }
 
 func (c *Conn) pinger(ctx context.Context) {
-	pongMessge := wsutil.Message{
-		OpCode:  gobwas.OpPong,
-		Payload: []byte{},
-	}
+	period := c.pingPeriod(ctx)
+	timeout := period + c.pongWait(ctx)
 
-	ticker := time.NewTicker(c.pingPeriod(ctx))
+	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
+			idle := time.Since(time.Unix(0, c.lastSeen.Load()))
+			if c.keepalive.Load() && idle > timeout {
+				log.Debugln("Closing websocket silent for %s.", idle.Round(time.Second))
+				c.abort()
+				return
+			}
 			done, err := c.ping()
 			if done {
 				return
 			}
 			if err != nil {
-				println("failed to write ping message")
-			}
-			if err := wsutil.HandleClientControlMessage(c.rw, pongMessge); err != nil {
-				println("failed to write pong message")
+				log.Debugln("Failed to write ping message: %v", err)
+				c.abort()
+				return
 			}
 		case <-ctx.Done():
 			return
@@ -79,19 +122,68 @@ func (c *Conn) pinger(ctx context.Context) {
 	}
 }
 
+// abort closes c and unblocks the pending Read.
+func (c *Conn) abort() {
+	c.Close()
+	_ = setReadDeadline(c.rw, time.Now())
+}
+
 func (c *Conn) Close() {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 	c.done = true
 }
 
-// Read will read messages from the websocket connection
+// Read will read messages from the websocket connection. Control frames are
+// answered under the write lock, so they never interleave with Write.
 func (c *Conn) Read(reader []byte) (int, error) {
-	data, err := wsutil.ReadClientBinary(c.rw)
-	if err != nil {
-		return 0, err
+	rd := wsutil.Reader{
+		Source:         c.rw,
+		State:          gobwas.StateServerSide,
+		OnIntermediate: c.handleControl,
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.lastSeen.Store(time.Now().UnixNano())
+		if hdr.OpCode.IsControl() {
+			if err = c.handleControl(hdr, &rd); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if hdr.OpCode&gobwas.OpBinary == 0 {
+			if err = rd.Discard(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		data, err := io.ReadAll(&rd)
+		if err != nil {
+			return 0, err
+		}
+		return copy(reader, data), nil
 	}
-	return copy(reader, data), nil
+}
+
+func (c *Conn) handleControl(hdr gobwas.Header, r io.Reader) error {
+	if hdr.OpCode == gobwas.OpPing || hdr.OpCode == gobwas.OpPong {
+		c.keepalive.Store(true)
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	var dst io.Writer = c.rw
+	if c.done {
+		dst = io.Discard
+	}
+	return wsutil.ControlHandler{
+		Src:                 r,
+		Dst:                 dst,
+		State:               gobwas.StateServerSide,
+		DisableSrcCiphering: true,
+	}.Handle(hdr)
 }
 
 // Write will write messages to the websocket connection.
@@ -109,3 +201,7 @@ func (c *Conn) Write(p []byte) (int, error) {
 
 	return len(p), nil
 }
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"github.com/fmnx/cftun/client/tun/proxy"
+	"github.com/fmnx/cftun/client/tun/transport/argo"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Chain forwards every stream to the tunnel hostname of another cftun server,
+// which then dials the final destination.
+type Chain struct {
+	Url      string `yaml:"url" json:"url"`
+	CdnIp    string `yaml:"cdn-ip" json:"cdn-ip"`
+	CdnPort  int    `yaml:"cdn-port" json:"cdn-port"`
+	Scheme   string `yaml:"scheme" json:"scheme"`
+	PoolSize int32  `yaml:"pool-size" json:"pool-size"`
+	AuthKey  string `yaml:"auth-key" json:"auth-key"`
+}
+
+func (c *Chain) params() *argo.Params {
+	params := &argo.Params{
+		Scheme:   c.Scheme,
+		CdnIP:    c.CdnIp,
+		Url:      c.Url,
+		Port:     c.CdnPort,
+		PoolSize: c.PoolSize,
+		AuthKey:  c.AuthKey,
+	}
+	if params.Port == 0 {
+		params.Port = 443
+	}
+	if params.Scheme == "" {
+		params.Scheme = "wss"
+		switch params.Port {
+		case 80, 8080, 8880, 2052, 2082, 2086, 2095:
+			params.Scheme = "ws"
+		}
+	}
+	return params
+}
+
+func (c *Chain) newDialer() cfd.ChainFunc {
+	if c == nil {
+		return nil
+	}
+	a := proxy.NewArgo(c.params())
+	// Pooled connections are dialed before their stream is known, so they
+	// can only serve streams that come straight from a client.
+	a.SetHeader("Forward-Hops", "1")
+	log.Infoln("Chaining all streams through %s", a.Addr())
+
+	return func(network, address string, hops int) (net.Conn, error) {
+		if hops == 1 {
+			return a.DialAddress(network, address, nil)
+		}
+		header := make(http.Header)
+		header.Set("Forward-Hops", strconv.Itoa(hops))
+		return a.DialAddress(network, address, header)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/metrics"
 	"github.com/fmnx/cftun/server/cfd"
 	"github.com/google/uuid"
 	"net"
@@ -34,11 +35,30 @@ func (bi *BuildInfo) UserAgent() string {
 }
 
 type Config struct {
-	EdgeIPs     []string `yaml:"edge-ips" json:"edge-ips"`
-	Token       string   `yaml:"token" json:"token"`
-	HaConn      int      `yaml:"ha-conn" json:"ha-conn"`
-	BindAddress string   `yaml:"bind-address" json:"bind-address"`
-	Warp        *Warp    `yaml:"warp" json:"warp"`
+	EdgeIPs         []string                `yaml:"edge-ips" json:"edge-ips"`
+	Token           string                  `yaml:"token" json:"token"`
+	HaConn          int                     `yaml:"ha-conn" json:"ha-conn"`
+	BindAddress     string                  `yaml:"bind-address" json:"bind-address"`
+	Warp            *Warp                   `yaml:"warp" json:"warp"`
+	StateDir        string                  `yaml:"state-dir" json:"state-dir"`
+	QuickHooks      *QuickHooks             `yaml:"quick-hooks" json:"quick-hooks"`
+	Egress          *Egress                 `yaml:"egress" json:"egress"`
+	AuthKeys        map[string]string       `yaml:"auth-keys" json:"auth-keys"`
+	Limits          *cfd.Limits             `yaml:"limits" json:"limits"`
+	Quotas          *cfd.Quotas             `yaml:"quotas" json:"quotas"`
+	Admission       *cfd.Admission          `yaml:"admission" json:"admission"`
+	Chain           *Chain                  `yaml:"chain" json:"chain"`
+	MaxHops         int                     `yaml:"max-hops" json:"max-hops"`
+	Services        map[string]*cfd.Service `yaml:"services" json:"services"`
+	DisableRaw      bool                    `yaml:"disable-raw" json:"disable-raw"`
+	VirtualServers  []*VirtualServer        `yaml:"virtual-servers" json:"virtual-servers"`
+	Listen          *Listen                 `yaml:"listen" json:"listen"`
+	Default         string                  `yaml:"default" json:"default"`
+	DefaultProtocol string                  `yaml:"default-protocol" json:"default-protocol"`
+	Metrics         string                  `yaml:"metrics" json:"metrics"`
+	Keepalive       *cfd.Keepalive          `yaml:"keepalive" json:"keepalive"`
+
+	quotas *cfd.QuotaTracker
 }
 
 func (server *Config) Run(info *BuildInfo, quickData *QuickData) {
@@ -46,22 +66,72 @@ func (server *Config) Run(info *BuildInfo, quickData *QuickData) {
 		server.HaConn = 4
 	}
 
+	if err := SetStateDir(server.StateDir); err != nil {
+		log.Fatalln("Failed to create state directory: %v", err)
+	}
+
 	if server.Token == "quick" {
 		if err := quickData.Load(); err != nil {
-			quickData.Token, quickData.QuickURL, err = ApplyQuickURL(info)
+			quickData.Token, quickData.QuickURL, err = ApplyQuickURLWithRetry(info)
 			if err != nil {
 				log.Fatalln(err.Error())
 			}
+			go server.QuickHooks.Publish(quickData.QuickURL)
 		}
 		server.Token = quickData.Token
+		quickData.Save()
+		go quickData.KeepAlive(quickKeepAliveInterval)
 		log.Infoln("\033[36mTHE TEMPORARY DOMAIN YOU HAVE APPLIED FOR IS: \033[0m%s", quickData.QuickURL)
 	}
 
-	dialFunc := net.Dial
-	var proxy4, proxy6 bool
-	if server.Warp != nil && (server.Warp.Proxy4 || server.Warp.Proxy6) {
-		dialFunc = server.Warp.Run()
-		proxy4, proxy6 = server.Warp.Proxy4, server.Warp.Proxy6
+	direct := server.Egress.newDialer().Dial
+	var warp cfd.DialFunc
+	if server.Warp != nil && (server.Warp.Proxy4 || server.Warp.Proxy6 || server.useWarp()) {
+		warp = server.Warp.Run(direct)
+	}
+	proxy := &cfd.Proxy{
+		Direct: direct,
+		Chain:  server.Chain.newDialer(),
+	}
+	if proxy.Chain != nil && server.Warp != nil {
+		log.Warnln("Both chain and warp are configured, chain is used.")
+	} else if server.Warp != nil && (server.Warp.Proxy4 || server.Warp.Proxy6) {
+		proxy.DialFunc = warp
+		proxy.Proxy4, proxy.Proxy6 = server.Warp.Proxy4, server.Warp.Proxy6
+	}
+
+	if server.Metrics != "" {
+		go metrics.Serve(server.Metrics)
+	}
+
+	server.quotas = newQuotaTracker(server.Quotas)
+
+	policy := &cfd.Policy{
+		AuthKeys:   server.AuthKeys,
+		Limiter:    cfd.NewLimiter(server.Limits),
+		Quotas:     server.quotas,
+		Admission:  server.Admission,
+		MaxHops:    server.MaxHops,
+		Services:   server.Services,
+		DisableRaw: server.DisableRaw,
+	}
+	var virtualServers []*cfd.VirtualServer
+	for _, v := range server.VirtualServers {
+		virtualServers = append(virtualServers, v.build(policy, proxy, direct, warp))
+	}
+
+	handler := cfd.NewHandler(&cfd.VirtualServer{
+		Default:         server.Default,
+		DefaultProtocol: server.DefaultProtocol,
+		Proxy:           proxy,
+		Policy:          policy,
+	}, virtualServers)
+	handler.Keepalive = server.Keepalive
+	if server.Listen != nil {
+		go server.Listen.serve(handler)
+	}
+	if server.Token == "" {
+		return
 	}
 
 	clientID, _ := uuid.NewRandom()
@@ -81,11 +151,7 @@ func (server *Config) Run(info *BuildInfo, quickData *QuickData) {
 		HaConn:       server.HaConn,
 		EdgeIPS:      edgeIPS,
 		EdgeBindAddr: net.ParseIP(server.BindAddress),
-		Proxy: &cfd.Proxy{
-			DialFunc: dialFunc,
-			Proxy4:   proxy4,
-			Proxy6:   proxy6,
-		},
+		Handler:      handler,
 		ClientInfo: &cfd.ClientInfo{
 			ClientID: clientID[:],
 			Version:  info.CloudflaredVersion,
@@ -104,3 +170,20 @@ func (server *Config) Run(info *BuildInfo, quickData *QuickData) {
 		}()
 	}
 }
+
+func (server *Config) useWarp() bool {
+	for _, v := range server.VirtualServers {
+		if v.Outbound == OutboundWarp && v.Chain == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop persists the state that is otherwise saved periodically.
+func (server *Config) Stop() {
+	if server == nil || server.quotas == nil {
+		return
+	}
+	saveUsage(server.quotas)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/fmnx/cftun/client/tun/dialer"
+	"net"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	// RFC 8305 recommends 250ms between connection attempts and 50ms of resolution delay.
+	defaultAttemptDelay = 250 * time.Millisecond
+	resolutionDelay     = 50 * time.Millisecond
+)
+
+// Egress configures the sockets the server dials origins with.
+type Egress struct {
+	Interface      string `yaml:"interface" json:"interface"`
+	RoutingMark    int    `yaml:"routing-mark" json:"routing-mark"`
+	ConnectTimeout int    `yaml:"connect-timeout" json:"connect-timeout"` // seconds
+	KeepAlive      int    `yaml:"keepalive" json:"keepalive"`             // seconds, negative disables
+	NoDelay        *bool  `yaml:"no-delay" json:"no-delay"`
+	AttemptDelay   int    `yaml:"attempt-delay" json:"attempt-delay"` // milliseconds
+}
+
+type egressDialer struct {
+	dialer       *net.Dialer
+	noDelay      bool
+	attemptDelay time.Duration
+}
+
+func (e *Egress) newDialer() *egressDialer {
+	if e == nil {
+		e = &Egress{}
+	}
+	d := &egressDialer{
+		dialer: &net.Dialer{
+			Timeout:   defaultConnectTimeout,
+			KeepAlive: time.Duration(e.KeepAlive) * time.Second,
+		},
+		noDelay:      true,
+		attemptDelay: defaultAttemptDelay,
+	}
+	if e.ConnectTimeout > 0 {
+		d.dialer.Timeout = time.Duration(e.ConnectTimeout) * time.Second
+	}
+	if e.NoDelay != nil {
+		d.noDelay = *e.NoDelay
+	}
+	if e.AttemptDelay > 0 {
+		d.attemptDelay = time.Duration(e.AttemptDelay) * time.Millisecond
+	}
+	if e.Interface != "" || e.RoutingMark != 0 {
+		opts := &dialer.Options{
+			InterfaceName: e.Interface,
+			RoutingMark:   e.RoutingMark,
+		}
+		d.dialer.Control = opts.Control
+	}
+	return d
+}
+
+func (d *egressDialer) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.dialer.Timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if net.ParseIP(host) != nil || network != "tcp" {
+		conn, err = d.dialer.DialContext(ctx, network, address)
+	} else {
+		conn, err = d.happyEyeballs(ctx, host, port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(d.noDelay)
+	}
+	return conn, nil
+}
+
+// happyEyeballs implements RFC 8305: both families are resolved concurrently,
+// addresses are interleaved starting with IPv6 and attempts are staggered by
+// attemptDelay, the first established connection wins.
+func (d *egressDialer) happyEyeballs(ctx context.Context, host, port string) (net.Conn, error) {
+	addrs, err := resolveInterleaved(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(addrs))
+	attempt := func(ip net.IP) {
+		conn, err := d.dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		results <- result{conn, err}
+	}
+
+	next, pending := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var lastErr error
+	for next < len(addrs) || pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next++
+				pending++
+				timer.Reset(d.attemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close the connections that lose the race.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			// A failed attempt starts the next one right away.
+			if next < len(addrs) {
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+func resolveInterleaved(ctx context.Context, host string) ([]net.IP, error) {
+	type answer struct {
+		ips []net.IP
+		err error
+	}
+	lookup := func(network string, ch chan<- answer) {
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+		ch <- answer{ips, err}
+	}
+	ch6, ch4 := make(chan answer, 1), make(chan answer, 1)
+	go lookup("ip6", ch6)
+	go lookup("ip4", ch4)
+
+	var v4, v6 answer
+	select {
+	case v6 = <-ch6:
+		v4 = <-ch4
+	case v4 = <-ch4:
+		// Give AAAA a short head start before settling for IPv4 only.
+		select {
+		case v6 = <-ch6:
+		case <-time.After(resolutionDelay):
+			go func() { <-ch6 }()
+		}
+	}
+
+	var addrs []net.IP
+	for i := 0; i < len(v6.ips) || i < len(v4.ips); i++ {
+		if i < len(v6.ips) {
+			addrs = append(addrs, v6.ips[i])
+		}
+		if i < len(v4.ips) {
+			addrs = append(addrs, v4.ips[i])
+		}
+	}
+	if len(addrs) == 0 {
+		if v4.err != nil {
+			return nil, v4.err
+		}
+		if v6.err != nil {
+			return nil, v6.err
+		}
+		return nil, errors.New("no addresses for " + host)
+	}
+	return addrs, nil
+}
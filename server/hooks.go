@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+const hookTimeout = 30 * time.Second
+
+// QuickHooks publishes the try.cloudflare.com hostname whenever a new one is applied for.
+type QuickHooks struct {
+	File    string `yaml:"file" json:"file"`
+	Command string `yaml:"command" json:"command"`
+	Webhook string `yaml:"webhook" json:"webhook"`
+}
+
+type quickHookPayload struct {
+	Hostname string    `json:"hostname"`
+	URL      string    `json:"url"`
+	Time     time.Time `json:"time"`
+}
+
+func (h *QuickHooks) Publish(hostname string) {
+	if h == nil {
+		return
+	}
+	if h.File != "" {
+		if err := os.WriteFile(h.File, []byte(hostname+"\n"), 0644); err != nil {
+			log.Errorln("Quick hook: failed to write %s: %v", h.File, err)
+		}
+	}
+	if h.Command != "" {
+		if err := h.runCommand(hostname); err != nil {
+			log.Errorln("Quick hook: command failed: %v", err)
+		}
+	}
+	if h.Webhook != "" {
+		if err := h.postWebhook(hostname); err != nil {
+			log.Errorln("Quick hook: webhook failed: %v", err)
+		}
+	}
+}
+
+func (h *QuickHooks) runCommand(hostname string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.Command)
+	}
+	cmd.Env = append(os.Environ(),
+		"CFTUN_QUICK_HOSTNAME="+hostname,
+		"CFTUN_QUICK_URL=https://"+hostname,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func (h *QuickHooks) postWebhook(hostname string) error {
+	body, _ := json.Marshal(&quickHookPayload{
+		Hostname: hostname,
+		URL:      "https://" + hostname,
+		Time:     time.Now(),
+	})
+
+	client := http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(h.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"net/http"
+	"time"
+)
+
+const (
+	listenReadHeaderTimeout = 10 * time.Second
+	// listenIdleTimeout closes idle keep-alive connections, the websockets are
+	// hijacked and not affected.
+	listenIdleTimeout = 120 * time.Second
+)
+
+// Listen accepts the client's websocket connections directly, behind a reverse
+// proxy, another CDN or on a LAN, instead of or next to the Cloudflare tunnel.
+type Listen struct {
+	Address      string `yaml:"address" json:"address"`
+	CertFile     string `yaml:"cert-file" json:"cert-file"`
+	KeyFile      string `yaml:"key-file" json:"key-file"`
+	RealIPHeader string `yaml:"real-ip-header" json:"real-ip-header"`
+}
+
+func (l *Listen) serve(handler *cfd.Handler) {
+	srv := &http.Server{
+		Addr:              l.Address,
+		Handler:           handler.HTTPHandler(l.RealIPHeader),
+		ReadHeaderTimeout: listenReadHeaderTimeout,
+		IdleTimeout:       listenIdleTimeout,
+	}
+	var err error
+	if l.CertFile != "" && l.KeyFile != "" {
+		log.Infoln("Websocket listen on https://%s", l.Address)
+		err = srv.ListenAndServeTLS(l.CertFile, l.KeyFile)
+	} else {
+		log.Infoln("Websocket listen on http://%s", l.Address)
+		err = srv.ListenAndServe()
+	}
+	log.Fatalln("Websocket listener error: %v", err)
+}
@@ -8,17 +8,30 @@ import (
 	"github.com/google/uuid"
 	"io"
 	"net/http"
-	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 const httpTimeout = 15 * time.Second
+const quickKeepAliveInterval = time.Minute
+
+const (
+	quickRetryMinDelay = 30 * time.Second
+	quickRetryMaxDelay = 10 * time.Minute
+	quickMaxRetries    = 8
+)
+
+var errQuickRateLimited = errors.New("quick tunnel request rate limited (error code: 1015)")
+
 const apiUrl = "https://api.trycloudflare.com/tunnel"
 
 type QuickData struct {
 	Token      string    `json:"token"`
 	QuickURL   string    `json:"quick-url"`
 	LastActive time.Time `json:"last-active"`
+
+	mu sync.Mutex
 }
 
 type QuickTunnelResponse struct {
@@ -41,7 +54,7 @@ type QuickTunnel struct {
 }
 
 func (qd *QuickData) Load() error {
-	buf, err := os.ReadFile(".quick.json")
+	buf, err := readState(quickStateFile)
 	if err != nil {
 		return err
 	}
@@ -59,20 +72,33 @@ func (qd *QuickData) Load() error {
 }
 
 func (qd *QuickData) Save() {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
 	qd.LastActive = time.Now()
 	// 将内存中的数据静态化
 	updateFile, err := json.MarshalIndent(qd, "", "  ")
 	if err != nil {
-		log.Errorln("Error generating JSON:", err)
+		log.Errorln("Error generating JSON: %v", err)
 		return
 	}
-	err = os.WriteFile(".quick.json", updateFile, 0644)
+	// The token is the tunnel secret, keep it private.
+	err = writeState(quickStateFile, updateFile, 0600)
 	if err != nil {
-		log.Errorln("Error writing config file:", err)
+		log.Errorln("Error writing quick state file: %v", err)
 		return
 	}
 }
 
+// KeepAlive refreshes LastActive on disk while the tunnel is running, so the
+// domain survives a crash as long as we come back within the expiry window.
+func (qd *QuickData) KeepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		qd.Save()
+	}
+}
+
 func ApplyQuickURL(buildInfo *BuildInfo) (string, string, error) {
 	client := http.Client{
 		Transport: &http.Transport{
@@ -102,8 +128,8 @@ func ApplyQuickURL(buildInfo *BuildInfo) (string, string, error) {
 		return "", "", errors.New("failed to read quick-tunnel response")
 	}
 
-	if string(rspBody) == "error code: 1015" {
-		println("limit")
+	if resp.StatusCode == http.StatusTooManyRequests || strings.TrimSpace(string(rspBody)) == "error code: 1015" {
+		return "", "", errQuickRateLimited
 	}
 
 	var data QuickTunnelResponse
@@ -130,3 +156,17 @@ func ApplyQuickURL(buildInfo *BuildInfo) (string, string, error) {
 
 	return token, data.Result.Hostname, nil
 }
+
+// ApplyQuickURLWithRetry backs off exponentially while try.cloudflare.com rate limits us.
+func ApplyQuickURLWithRetry(buildInfo *BuildInfo) (string, string, error) {
+	delay := quickRetryMinDelay
+	for i := 0; ; i++ {
+		token, hostname, err := ApplyQuickURL(buildInfo)
+		if !errors.Is(err, errQuickRateLimited) || i >= quickMaxRetries {
+			return token, hostname, err
+		}
+		log.Warnln("Quick tunnel request rate limited, retrying in %s.", delay)
+		time.Sleep(delay)
+		delay = min(delay*2, quickRetryMaxDelay)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"os"
+	"time"
+)
+
+const (
+	usageStateFile    = ".usage.json"
+	usageSaveInterval = time.Minute
+)
+
+// LoadUsage reads the traffic saved under the state directory. A missing file
+// means no traffic was accounted yet.
+func LoadUsage() (map[string]*cfd.Usage, error) {
+	buf, err := readState(usageStateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]*cfd.Usage)
+	if err = json.Unmarshal(buf, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func saveUsage(tracker *cfd.QuotaTracker) {
+	buf, err := json.MarshalIndent(tracker.Snapshot(), "", "  ")
+	if err != nil {
+		return
+	}
+	if err = writeState(usageStateFile, buf, 0600); err != nil {
+		log.Errorln("Failed to save usage: %v", err)
+	}
+}
+
+// newQuotaTracker restores the saved traffic of every client and keeps saving it.
+func newQuotaTracker(quotas *cfd.Quotas) *cfd.QuotaTracker {
+	tracker := cfd.NewQuotaTracker(quotas)
+	if tracker == nil {
+		return nil
+	}
+	usage, err := LoadUsage()
+	if err != nil {
+		log.Warnln("Failed to load usage, starting from zero: %v", err)
+	}
+	tracker.Restore(usage)
+	go func() {
+		ticker := time.NewTicker(usageSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			saveUsage(tracker)
+		}
+	}()
+	return tracker
+}
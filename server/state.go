@@ -0,0 +1,76 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	quickStateFile = ".quick.json"
+	warpStateFile  = ".warp.json"
+)
+
+// stateDir is where quick/warp data is persisted. systemd exposes the unit's
+// StateDirectory= through $STATE_DIRECTORY, which takes precedence over the
+// working directory when no state-dir is configured.
+var stateDir = os.Getenv("STATE_DIRECTORY")
+
+func SetStateDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	stateDir = dir
+	return nil
+}
+
+func StateDir() string {
+	return stateDir
+}
+
+func statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
+
+func readState(name string) ([]byte, error) {
+	return os.ReadFile(statePath(name))
+}
+
+// writeState replaces the state file atomically, so that a crash while
+// writing never leaves a truncated file behind.
+func writeState(name string, data []byte, perm os.FileMode) error {
+	path := statePath(name)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if err = tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+func removeState(name string) error {
+	err := os.Remove(statePath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+)
+
+const (
+	OutboundDirect = "direct"
+	OutboundWarp   = "warp"
+)
+
+// VirtualServer is a profile for the streams sent to one public hostname and
+// path prefix of the tunnel. Unset or empty auth keys and unset services are
+// inherited from the server, and disable-raw can only add to the server's.
+// Limits, quotas and admission are always shared.
+type VirtualServer struct {
+	Host            string                  `yaml:"host" json:"host"`
+	Path            string                  `yaml:"path" json:"path"`
+	AuthKeys        map[string]string       `yaml:"auth-keys" json:"auth-keys"`
+	Services        map[string]*cfd.Service `yaml:"services" json:"services"`
+	DisableRaw      bool                    `yaml:"disable-raw" json:"disable-raw"`
+	Default         string                  `yaml:"default" json:"default"`
+	DefaultProtocol string                  `yaml:"default-protocol" json:"default-protocol"`
+	// Outbound is direct or warp, the server's outbound when empty and chain is unset.
+	Outbound string `yaml:"outbound" json:"outbound"`
+	Chain    *Chain `yaml:"chain" json:"chain"`
+}
+
+func (v *VirtualServer) build(base *cfd.Policy, proxy *cfd.Proxy, direct, warp cfd.DialFunc) *cfd.VirtualServer {
+	policy := *base
+	policy.DisableRaw = base.DisableRaw || v.DisableRaw
+	// An empty map must not turn authentication off.
+	if len(v.AuthKeys) > 0 {
+		policy.AuthKeys = v.AuthKeys
+	}
+	if v.Services != nil {
+		policy.Services = v.Services
+	}
+
+	switch {
+	case v.Chain != nil:
+		proxy = &cfd.Proxy{Direct: direct, Chain: v.Chain.newDialer()}
+	case v.Outbound == OutboundDirect:
+		proxy = &cfd.Proxy{Direct: direct}
+	case v.Outbound == OutboundWarp && warp != nil:
+		proxy = &cfd.Proxy{DialFunc: warp, Direct: direct, Proxy4: true, Proxy6: true}
+	case v.Outbound == OutboundWarp:
+		log.Warnln("Virtual server %s%s wants warp, but warp is not configured.", v.Host, v.Path)
+	}
+
+	return &cfd.VirtualServer{
+		Host:            v.Host,
+		Path:            v.Path,
+		Default:         v.Default,
+		DefaultProtocol: v.DefaultProtocol,
+		Proxy:           proxy,
+		Policy:          &policy,
+	}
+}
@@ -1,13 +1,10 @@
 package server
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"github.com/fmnx/cftun/log"
 	"github.com/fmnx/cftun/server/cfd"
-	"github.com/tidwall/gjson"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
@@ -15,7 +12,6 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
-	"os"
 	"strings"
 	"time"
 )
@@ -31,6 +27,25 @@ type Warp struct {
 	Reserved   []byte `yaml:"reserved" json:"reserved"`
 	Proxy4     bool   `yaml:"proxy4" json:"proxy4"`
 	Proxy6     bool   `yaml:"proxy6" json:"proxy6"`
+	API        string `yaml:"api" json:"api,omitempty"`
+	ID         string `yaml:"id" json:"id,omitempty"`
+	Token      string `yaml:"token" json:"token,omitempty"`
+	License    string `yaml:"license" json:"license,omitempty"`
+
+	// Health monitoring, see warp_monitor.go.
+	Endpoints     []string `yaml:"endpoints" json:"endpoints,omitempty"`
+	CheckInterval int      `yaml:"check-interval" json:"check-interval,omitempty"`
+	ProbeAddress  string   `yaml:"probe-address" json:"probe-address,omitempty"`
+	Fallback      string   `yaml:"fallback" json:"fallback,omitempty"`
+
+	// Scan picks the endpoint by handshake latency at startup, see warp_scan.go.
+	Scan *WarpScan `yaml:"scan" json:"scan,omitempty"`
+}
+
+type warpTunnel struct {
+	tnet *netstack.Net
+	dev  *device.Device
+	peer *device.IpcSetPeer
 }
 
 func (w *Warp) verify() bool {
@@ -38,90 +53,140 @@ func (w *Warp) verify() bool {
 }
 
 func (w *Warp) load() {
-	buf, err := os.ReadFile(".warp.json")
-	if err != nil {
+	if err := w.LoadState(); err != nil {
 		w.apply()
 		w.save()
-	} else {
-		proxy4, proxy6 := w.Proxy4, w.Proxy6
-		_ = json.Unmarshal(buf, w)
-		w.Proxy4, w.Proxy6 = proxy4, proxy6
 	}
+}
+
+// LoadState overlays the persisted account onto w, keeping the options that
+// only come from the configuration.
+func (w *Warp) LoadState() error {
+	buf, err := readState(warpStateFile)
+	if err != nil {
+		return err
+	}
+	state := &Warp{}
+	if err = json.Unmarshal(buf, state); err != nil {
+		return err
+	}
+	w.setIdentity(state)
+	return nil
+}
 
+func (w *Warp) setIdentity(s *Warp) {
+	w.Endpoint, w.IPv4, w.IPv6 = s.Endpoint, s.IPv4, s.IPv6
+	w.PrivateKey, w.PublicKey, w.Reserved = s.PrivateKey, s.PublicKey, s.Reserved
+	w.ID, w.Token, w.License = s.ID, s.Token, s.License
 }
 
 func (w *Warp) save() {
+	if err := w.SaveState(); err != nil {
+		log.Errorln("Error writing warp state file: %v", err)
+	}
+}
+
+func (w *Warp) SaveState() error {
 	// 将内存中的数据静态化
 	warpFile, _ := json.MarshalIndent(w, "", "  ")
-	err := os.WriteFile(".warp.json", warpFile, 0644)
-	if err != nil {
-		log.Errorln("Error writing warp config file: %v", err)
-		return
-	}
+	// Contains the WireGuard private key.
+	return writeState(warpStateFile, warpFile, 0600)
 }
 
-func (w *Warp) apply() {
+func (w *Warp) RemoveState() error {
+	return removeState(warpStateFile)
+}
 
+func (w *Warp) apply() {
 	log.Infoln("Automatically applying for Warp...")
-
-	url := "https://api.cloudflareclient.com/v0a2223/reg"
-
-	privateKey := NewPrivateKey()
-	// 请求头
-	headers := map[string]string{
-		"CF-Client-Version": "a-6.11-2223",
-		"Host":              "api.cloudflareclient.com",
-		"Connection":        "Keep-Alive",
-		"Accept-Encoding":   "gzip",
-		"User-Agent":        "okhttp/3.12.1",
-		"Content-Type":      "application/json",
+	if err := w.Register(); err != nil {
+		log.Fatalln("Failed to automatically apply for Warp: %v", err)
 	}
+	log.Infoln("Warp has been successfully applied.")
+}
 
-	jsonData, _ := json.Marshal(map[string]string{
-		"key":    privateKey.Public().String(),
-		"locale": "en-US",
-		"tos":    time.Now().Format(time.RFC3339Nano),
-	})
+// Register replaces the current identity with a freshly registered free account.
+func (w *Warp) Register() error {
+	reg, err := newWarpAPI(w.API).register(NewPrivateKey())
+	if err != nil {
+		return err
+	}
+	w.setIdentity(reg)
+	return nil
+}
 
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+func (w *Warp) registered() error {
+	if w.ID == "" || w.Token == "" {
+		return errors.New("no registered warp account, run 'cftun warp register' first")
+	}
+	return nil
+}
 
-	for key, value := range headers {
-		req.Header.Set(key, value)
+// SetLicense binds a WARP+ license key to the account.
+func (w *Warp) SetLicense(license string) error {
+	if err := w.registered(); err != nil {
+		return err
+	}
+	if err := newWarpAPI(w.API).setLicense(w.ID, w.Token, license); err != nil {
+		return err
 	}
+	w.License = license
+	return nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalln("A request error occurred while automatically applying for Warp.: %v", err)
+// RotateKeys generates a new WireGuard key pair and uploads the public key.
+func (w *Warp) RotateKeys() error {
+	if err := w.registered(); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	privateKey := NewPrivateKey()
+	if err := newWarpAPI(w.API).updateKey(w.ID, w.Token, privateKey); err != nil {
+		return err
+	}
+	w.PrivateKey = privateKey.String()
+	return nil
+}
 
-	var reader io.ReadCloser
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		reader, _ = gzip.NewReader(resp.Body)
-		defer reader.Close()
-	} else {
-		reader = resp.Body
+func (w *Warp) Account() (*WarpAccount, error) {
+	if err := w.registered(); err != nil {
+		return nil, err
 	}
+	return newWarpAPI(w.API).account(w.ID, w.Token)
+}
 
-	body, _ := io.ReadAll(reader)
-	clientID := gjson.Get(string(body), "config.client_id").String()
-	ipv6 := gjson.Get(string(body), "config.interface.addresses.v6").String()
-	if ipv6 == "" {
-		log.Fatalln("Failed to automatically apply for Warp.")
+func (w *Warp) Deregister() error {
+	if err := w.registered(); err != nil {
+		return err
 	}
+	return newWarpAPI(w.API).deregister(w.ID, w.Token)
+}
 
-	w.Reserved, _ = base64.StdEncoding.DecodeString(clientID)
-	w.IPv4 = "172.16.0.2"
-	w.IPv6 = ipv6
-	w.PrivateKey = privateKey.String()
-	w.PublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
-	w.Endpoint = "engage.cloudflareclient.com:2408"
+// Trace fetches the Cloudflare trace page through the tunnel, which proves
+// that the handshake completes and traffic egresses via WARP.
+func (w *Warp) Trace() (string, error) {
+	probe := *w
+	probe.Port = 0 // don't collide with a running server.
+	t, err := probe.start()
+	if err != nil {
+		return "", err
+	}
+	defer t.dev.Close()
 
-	log.Infoln("Warp has been successfully applied.")
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: t.tnet.DialContext},
+		Timeout:   httpTimeout,
+	}
+	resp, err := client.Get("https://1.1.1.1/cdn-cgi/trace")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
 }
 
-func (w *Warp) Run() cfd.DialFunc {
+// Run brings WARP up and returns its dialer, direct is used when falling back.
+func (w *Warp) Run(direct cfd.DialFunc) cfd.DialFunc {
 
 	if w.Auto {
 		w.load()
@@ -129,6 +194,49 @@ func (w *Warp) Run() cfd.DialFunc {
 		log.Fatalln("The warp parameter is incorrect.")
 	}
 
+	t, err := w.start()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	monitor := newWarpMonitor(w, t, direct)
+	go monitor.run()
+	if w.Scan != nil {
+		go w.applyScan(monitor)
+	}
+	return monitor.Dial
+}
+
+// applyScan moves monitor to the best endpoint found, WARP runs through the
+// configured one meanwhile.
+func (w *Warp) applyScan(monitor *warpMonitor) {
+	opts := *w.Scan
+	if opts.Budget <= 0 {
+		opts.Budget = defaultWarpStartupScanBudget
+	}
+	log.Infoln("[WARP] scanning endpoints for up to %ds...", opts.Budget)
+	results, err := w.ScanEndpoints(&opts)
+	if err != nil {
+		log.Errorln("[WARP] endpoint scan failed: %v", err)
+		return
+	}
+	if len(results) == 0 {
+		log.Warnln("[WARP] no endpoint answered the handshake, keeping %s.", w.Endpoint)
+		return
+	}
+	log.Infoln("[WARP] best endpoint %s, rtt %s, loss %.0f%%.", results[0].Endpoint, results[0].RTT, results[0].Loss*100)
+	endpoints := make([]string, 0, len(results)+len(w.Endpoints))
+	for _, result := range results[1:] {
+		endpoints = append(endpoints, result.Endpoint)
+	}
+	w.Endpoints = append(endpoints, w.Endpoints...)
+	w.Endpoint = results[0].Endpoint
+	if w.Auto {
+		w.save()
+	}
+	monitor.setEndpoints(append([]string{w.Endpoint}, w.Endpoints...))
+}
+
+func (w *Warp) start() (*warpTunnel, error) {
 	if strings.Contains(w.IPv4, "/") {
 		w.IPv4 = strings.Split(w.IPv4, "/")[0]
 	}
@@ -136,9 +244,17 @@ func (w *Warp) Run() cfd.DialFunc {
 		w.IPv6 = strings.Split(w.IPv6, "/")[0]
 	}
 
-	localAddress := []netip.Addr{netip.MustParseAddr(w.IPv4)}
+	ipv4, err := netip.ParseAddr(w.IPv4)
+	if err != nil {
+		return nil, err
+	}
+	localAddress := []netip.Addr{ipv4}
 	if w.IPv6 != "" {
-		localAddress = append(localAddress, netip.MustParseAddr(w.IPv6))
+		ipv6, err := netip.ParseAddr(w.IPv6)
+		if err != nil {
+			return nil, err
+		}
+		localAddress = append(localAddress, ipv6)
 	}
 	tunDev, tnet, err := netstack.CreateNetTUN(
 		localAddress,
@@ -146,7 +262,7 @@ func (w *Warp) Run() cfd.DialFunc {
 		1280,
 	)
 	if err != nil {
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 
 	bind := conn.NewStdNetBind()
@@ -161,7 +277,7 @@ func (w *Warp) Run() cfd.DialFunc {
 
 	dev.SetEndpoint(peer, resolvEndpoint(w.Endpoint)).SetAllowedIP(peer)
 	peer.HandlePostConfig()
-	return tnet.Dial
+	return &warpTunnel{tnet: tnet, dev: dev, peer: peer}, nil
 }
 
 func resolvEndpoint(endpoint string) string {
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultWarpAPI = "https://api.cloudflareclient.com/v0a2223"
+
+var warpAPIHeaders = map[string]string{
+	"CF-Client-Version": "a-6.11-2223",
+	"Connection":        "Keep-Alive",
+	"Accept-Encoding":   "gzip",
+	"User-Agent":        "okhttp/3.12.1",
+	"Content-Type":      "application/json",
+}
+
+type WarpAccount struct {
+	ID          string `json:"id"`
+	AccountType string `json:"account_type"`
+	WarpPlus    bool   `json:"warp_plus"`
+	License     string `json:"license"`
+	Quota       int64  `json:"quota"`
+	Premium     int64  `json:"premium_data"`
+	Created     string `json:"created"`
+	Updated     string `json:"updated"`
+}
+
+type warpAPI struct {
+	base   string
+	client *http.Client
+}
+
+func newWarpAPI(base string) *warpAPI {
+	if base == "" {
+		base = defaultWarpAPI
+	}
+	return &warpAPI{
+		base:   strings.TrimSuffix(base, "/"),
+		client: &http.Client{Timeout: httpTimeout},
+	}
+}
+
+func (a *warpAPI) do(method, path, token string, payload any) (gjson.Result, error) {
+	var body io.Reader
+	if payload != nil {
+		buf, err := json.Marshal(payload)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, a.base+path, body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	for key, value := range warpAPIHeaders {
+		req.Header.Set(key, value)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+
+	var reader io.ReadCloser
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		reader, err = gzip.NewReader(resp.Body)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		defer reader.Close()
+	} else {
+		reader = resp.Body
+	}
+
+	rspBody, err := io.ReadAll(reader)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if resp.StatusCode >= 300 {
+		msg := gjson.GetBytes(rspBody, "errors.0.message").String()
+		if msg == "" {
+			msg = strings.TrimSpace(string(rspBody))
+		}
+		return gjson.Result{}, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, msg)
+	}
+	return gjson.ParseBytes(rspBody), nil
+}
+
+// register creates a new free account bound to the public key of privateKey.
+func (a *warpAPI) register(privateKey *Key) (*Warp, error) {
+	result, err := a.do(http.MethodPost, "/reg", "", map[string]string{
+		"key":    privateKey.Public().String(),
+		"locale": "en-US",
+		"tos":    time.Now().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := result.Get("config.interface.addresses.v6").String()
+	if ipv6 == "" {
+		return nil, errors.New("registration response carries no interface address")
+	}
+
+	w := &Warp{
+		ID:         result.Get("id").String(),
+		Token:      result.Get("token").String(),
+		IPv4:       result.Get("config.interface.addresses.v4").String(),
+		IPv6:       ipv6,
+		PrivateKey: privateKey.String(),
+		PublicKey:  result.Get("config.peers.0.public_key").String(),
+		Endpoint:   "engage.cloudflareclient.com:2408",
+		License:    result.Get("account.license").String(),
+	}
+	w.Reserved, _ = base64.StdEncoding.DecodeString(result.Get("config.client_id").String())
+	if w.IPv4 == "" {
+		w.IPv4 = "172.16.0.2"
+	}
+	if w.PublicKey == "" {
+		w.PublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+	}
+	return w, nil
+}
+
+func (a *warpAPI) account(id, token string) (*WarpAccount, error) {
+	result, err := a.do(http.MethodGet, "/reg/"+id+"/account", token, nil)
+	if err != nil {
+		return nil, err
+	}
+	account := &WarpAccount{}
+	if err = json.Unmarshal([]byte(result.Raw), account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (a *warpAPI) setLicense(id, token, license string) error {
+	_, err := a.do(http.MethodPut, "/reg/"+id+"/account", token, map[string]string{
+		"license": license,
+	})
+	return err
+}
+
+func (a *warpAPI) updateKey(id, token string, privateKey *Key) error {
+	_, err := a.do(http.MethodPatch, "/reg/"+id, token, map[string]string{
+		"key": privateKey.Public().String(),
+	})
+	return err
+}
+
+func (a *warpAPI) deregister(id, token string) error {
+	_, err := a.do(http.MethodDelete, "/reg/"+id, token, nil)
+	return err
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWarpCheckInterval = 30 * time.Second
+	defaultWarpProbeAddress  = "1.1.1.1:80"
+	warpProbeTimeout         = 5 * time.Second
+	// A WireGuard session is rejected after 180s without a new handshake.
+	warpHandshakeMaxAge = 180 * time.Second
+	// Consecutive failed checks before moving to the next endpoint.
+	warpMaxFailures = 2
+
+	WarpFallbackDirect = "direct"
+	WarpFallbackBlock  = "block"
+)
+
+var errWarpUnhealthy = errors.New("warp is unhealthy")
+
+type warpMonitor struct {
+	tunnel    *warpTunnel
+	direct    cfd.DialFunc
+	endpoints []string
+	interval  time.Duration
+	probe     string
+	fallback  string
+
+	mu       sync.Mutex
+	index    int
+	endpoint string
+	failures int
+	healthy  atomic.Bool
+}
+
+func newWarpMonitor(w *Warp, t *warpTunnel, direct cfd.DialFunc) *warpMonitor {
+	m := &warpMonitor{
+		tunnel:   t,
+		direct:   direct,
+		interval: defaultWarpCheckInterval,
+		probe:    w.ProbeAddress,
+		fallback: w.Fallback,
+		endpoint: w.Endpoint,
+	}
+	if w.CheckInterval > 0 {
+		m.interval = time.Duration(w.CheckInterval) * time.Second
+	}
+	if m.probe == "" {
+		m.probe = defaultWarpProbeAddress
+	}
+	if m.fallback == "" {
+		m.fallback = WarpFallbackDirect
+	}
+	m.endpoints = uniqueEndpoints(append([]string{w.Endpoint}, w.Endpoints...))
+	// Optimistic until the first check says otherwise.
+	m.healthy.Store(true)
+	return m
+}
+
+func uniqueEndpoints(list []string) []string {
+	seen := make(map[string]bool)
+	var endpoints []string
+	for _, endpoint := range list {
+		if endpoint != "" && !seen[endpoint] {
+			seen[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// setEndpoints switches to the first of endpoints and rotates through them from now on.
+func (m *warpMonitor) setEndpoints(endpoints []string) {
+	endpoints = uniqueEndpoints(endpoints)
+	if len(endpoints) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints, m.index, m.failures = endpoints, 0, 0
+	if m.endpoint == endpoints[0] {
+		return
+	}
+	m.endpoint = resolvEndpoint(endpoints[0])
+	m.tunnel.dev.SetEndpoint(m.tunnel.peer, m.endpoint)
+	log.Infoln("[WARP] switched endpoint to %s (%s).", endpoints[0], m.endpoint)
+}
+
+// Dial goes through WARP while it is healthy and applies the fallback policy otherwise.
+func (m *warpMonitor) Dial(network, address string) (net.Conn, error) {
+	if m.healthy.Load() {
+		return m.tunnel.tnet.Dial(network, address)
+	}
+	if m.fallback == WarpFallbackBlock {
+		return nil, errWarpUnhealthy
+	}
+	return m.direct(network, address)
+}
+
+func (m *warpMonitor) run() {
+	m.check()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.check()
+	}
+}
+
+func (m *warpMonitor) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), warpProbeTimeout)
+	c, err := m.tunnel.tnet.DialContext(ctx, "tcp", m.probe)
+	cancel()
+	if c != nil {
+		_ = c.Close()
+	}
+
+	age, handshaked := m.handshakeAge()
+	if err == nil && (!handshaked || age > warpHandshakeMaxAge) {
+		err = errors.New("no recent handshake")
+	}
+
+	if err == nil {
+		m.failures = 0
+		if !m.healthy.Swap(true) {
+			log.Infoln("[WARP] healthy again via %s, last handshake %s ago.", m.endpoint, age.Truncate(time.Second))
+		} else {
+			log.Debugln("[WARP] healthy via %s, last handshake %s ago.", m.endpoint, age.Truncate(time.Second))
+		}
+		return
+	}
+
+	m.failures++
+	if m.healthy.Swap(false) {
+		log.Warnln("[WARP] unhealthy via %s: %v, falling back to %s.", m.endpoint, err, m.fallback)
+	} else {
+		log.Debugln("[WARP] still unhealthy via %s: %v", m.endpoint, err)
+	}
+	if m.failures >= warpMaxFailures && len(m.endpoints) > 0 {
+		m.failures = 0
+		m.index = (m.index + 1) % len(m.endpoints)
+		m.endpoint = resolvEndpoint(m.endpoints[m.index])
+		m.tunnel.dev.SetEndpoint(m.tunnel.peer, m.endpoint)
+		log.Infoln("[WARP] switched endpoint to %s (%s).", m.endpoints[m.index], m.endpoint)
+	}
+}
+
+// handshakeAge reads the peer's last handshake time from the UAPI.
+func (m *warpMonitor) handshakeAge() (time.Duration, bool) {
+	conf, err := m.tunnel.dev.IpcGet()
+	if err != nil {
+		return 0, false
+	}
+	scanner := bufio.NewScanner(strings.NewReader(conf))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "last_handshake_time_sec" {
+			continue
+		}
+		sec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || sec == 0 {
+			return 0, false
+		}
+		return time.Since(time.Unix(sec, 0)), true
+	}
+	return 0, false
+}
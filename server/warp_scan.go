@@ -0,0 +1,385 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"math/big"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultWarpScanCIDRs = []string{
+		"162.159.192.0/24",
+		"162.159.193.0/24",
+		"162.159.195.0/24",
+		"188.114.96.0/24",
+		"188.114.97.0/24",
+		"188.114.98.0/24",
+		"188.114.99.0/24",
+	}
+	DefaultWarpScanPorts = []int{2408, 500, 1701, 4500}
+)
+
+const (
+	defaultWarpScanCount       = 3
+	defaultWarpScanTimeout     = time.Second
+	defaultWarpScanConcurrency = 64
+	defaultWarpScanMaxHosts    = 256
+	// The scan at startup runs in the background and stops after this long.
+	defaultWarpStartupScanBudget = 30
+)
+
+// WarpScan configures the endpoint scanner, both for "cftun warp scan" and at startup.
+type WarpScan struct {
+	CIDRs       []string `yaml:"cidrs" json:"cidrs"`
+	Ports       []int    `yaml:"ports" json:"ports"`
+	Count       int      `yaml:"count" json:"count"`
+	Timeout     int      `yaml:"timeout" json:"timeout"` // milliseconds
+	Concurrency int      `yaml:"concurrency" json:"concurrency"`
+	MaxHosts    int      `yaml:"max-hosts" json:"max-hosts"`
+	Top         int      `yaml:"top" json:"top"`
+	// Budget stops the scan after this many seconds, keeping what answered so far.
+	Budget int `yaml:"budget" json:"budget"`
+}
+
+type WarpScanResult struct {
+	Endpoint string        `json:"endpoint"`
+	RTT      time.Duration `json:"rtt"`
+	Loss     float64       `json:"loss"`
+}
+
+// ScanEndpoints probes every candidate endpoint with real handshake initiations made
+// from w's keys and reserved bytes, and returns the answering endpoints ranked
+// by loss and then by average handshake RTT.
+func (w *Warp) ScanEndpoints(opts *WarpScan) ([]*WarpScanResult, error) {
+	if opts == nil {
+		opts = &WarpScan{}
+	}
+	init, err := newWarpInitiator(w)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs, ports := opts.CIDRs, opts.Ports
+	if len(cidrs) == 0 {
+		cidrs = DefaultWarpScanCIDRs
+	}
+	if len(ports) == 0 {
+		ports = DefaultWarpScanPorts
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = defaultWarpScanCount
+	}
+	timeout := time.Duration(opts.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultWarpScanTimeout
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarpScanConcurrency
+	}
+	maxHosts := opts.MaxHosts
+	if maxHosts <= 0 {
+		maxHosts = defaultWarpScanMaxHosts
+	}
+
+	var endpoints []netip.AddrPort
+	for _, cidr := range cidrs {
+		hosts, err := scanHosts(cidr, maxHosts)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			for _, port := range ports {
+				endpoints = append(endpoints, netip.AddrPortFrom(host, uint16(port)))
+			}
+		}
+	}
+
+	var deadline time.Time
+	if opts.Budget > 0 {
+		deadline = time.Now().Add(time.Duration(opts.Budget) * time.Second)
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []*WarpScanResult
+		sem     = make(chan struct{}, concurrency)
+	)
+	for _, endpoint := range endpoints {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(endpoint netip.AddrPort) {
+			defer func() { <-sem; wg.Done() }()
+			if result := init.probe(endpoint, count, timeout); result != nil {
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}(endpoint)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Loss != results[j].Loss {
+			return results[i].Loss < results[j].Loss
+		}
+		return results[i].RTT < results[j].RTT
+	})
+	if opts.Top > 0 && len(results) > opts.Top {
+		results = results[:opts.Top]
+	}
+	return results, nil
+}
+
+// scanHosts expands a prefix, sampling at most maxHosts random addresses from large ones.
+func scanHosts(cidr string, maxHosts int) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(cidr); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits < 31 && 1<<hostBits <= maxHosts {
+		var hosts []netip.Addr
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			hosts = append(hosts, addr)
+		}
+		return hosts, nil
+	}
+
+	base := new(big.Int).SetBytes(prefix.Addr().AsSlice())
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	seen := make(map[netip.Addr]bool, maxHosts)
+	var hosts []netip.Addr
+	for len(hosts) < maxHosts {
+		offset, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+		buf := new(big.Int).Add(base, offset).FillBytes(make([]byte, prefix.Addr().BitLen()/8))
+		addr, _ := netip.AddrFromSlice(buf)
+		if !seen[addr] {
+			seen[addr] = true
+			hosts = append(hosts, addr)
+		}
+	}
+	return hosts, nil
+}
+
+const (
+	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1       = "mac1----"
+
+	messageInitiationType = 1
+	messageResponseType   = 2
+	messageInitiationSize = 148
+	messageResponseSize   = 92
+
+	// Peers drop initiations that arrive faster than this from one key.
+	handshakeInitiationGap = 100 * time.Millisecond
+)
+
+// warpInitiator builds WireGuard handshake initiations (Noise IK) for probing.
+type warpInitiator struct {
+	privateKey [32]byte
+	publicKey  [32]byte
+	peerKey    [32]byte
+	reserved   []byte
+	mac1Key    [blake2s.Size]byte
+}
+
+func newWarpInitiator(w *Warp) (*warpInitiator, error) {
+	init := &warpInitiator{reserved: w.Reserved}
+	if err := decodeKey(init.privateKey[:], w.PrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	if err := decodeKey(init.peerKey[:], w.PublicKey); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	curve25519.ScalarBaseMult(&init.publicKey, &init.privateKey)
+	init.mac1Key = blake2s.Sum256(append([]byte(wgLabelMAC1), init.peerKey[:]...))
+	return init, nil
+}
+
+func decodeKey(dst []byte, key string) error {
+	buf, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	if len(buf) != 32 {
+		return errors.New("key must be 32 bytes")
+	}
+	copy(dst, buf)
+	return nil
+}
+
+func (i *warpInitiator) probe(endpoint netip.AddrPort, count int, timeout time.Duration) *WarpScanResult {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(endpoint))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	var total time.Duration
+	var sent, received int
+	buf := make([]byte, 256)
+	// Most candidates never answer, stop at the first lost handshake instead of
+	// waiting for every timeout.
+	for sent == received && sent < count {
+		if sent > 0 {
+			time.Sleep(handshakeInitiationGap)
+		}
+		packet, sender, err := i.initiation()
+		if err != nil {
+			return nil
+		}
+		sent++
+		start := time.Now()
+		if _, err = conn.Write(packet); err != nil {
+			break
+		}
+		_ = conn.SetReadDeadline(start.Add(timeout))
+		for {
+			nr, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if nr == messageResponseSize && buf[0] == messageResponseType &&
+				binary.LittleEndian.Uint32(buf[8:12]) == sender {
+				total += time.Since(start)
+				received++
+				break
+			}
+		}
+	}
+	if received == 0 {
+		return nil
+	}
+	return &WarpScanResult{
+		Endpoint: endpoint.String(),
+		RTT:      total / time.Duration(received),
+		Loss:     float64(sent-received) / float64(sent),
+	}
+}
+
+func (i *warpInitiator) initiation() ([]byte, uint32, error) {
+	var ephemeralPriv, ephemeralPub [32]byte
+	if _, err := rand.Read(ephemeralPriv[:]); err != nil {
+		return nil, 0, err
+	}
+	ephemeralPriv[0] &= 248
+	ephemeralPriv[31] = (ephemeralPriv[31] & 127) | 64
+	curve25519.ScalarBaseMult(&ephemeralPub, &ephemeralPriv)
+
+	var senderBytes [4]byte
+	if _, err := rand.Read(senderBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	sender := binary.LittleEndian.Uint32(senderBytes[:])
+
+	chainKey := blake2s.Sum256([]byte(noiseConstruction))
+	h := mixHash(chainKey, []byte(wgIdentifier))
+	h = mixHash(h, i.peerKey[:])
+
+	msg := make([]byte, messageInitiationSize)
+	msg[0] = messageInitiationType
+	binary.LittleEndian.PutUint32(msg[4:8], sender)
+	copy(msg[8:40], ephemeralPub[:])
+
+	chainKey = kdf1(chainKey[:], ephemeralPub[:])
+	h = mixHash(h, ephemeralPub[:])
+
+	ss, err := curve25519.X25519(ephemeralPriv[:], i.peerKey[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	var key [32]byte
+	chainKey, key = kdf2(chainKey[:], ss)
+	static := seal(key, i.publicKey[:], h[:])
+	copy(msg[40:88], static)
+	h = mixHash(h, static)
+
+	ss, err = curve25519.X25519(i.privateKey[:], i.peerKey[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	_, key = kdf2(chainKey[:], ss)
+	timestamp := seal(key, tai64n(time.Now()), h[:])
+	copy(msg[88:116], timestamp)
+
+	mac, _ := blake2s.New128(i.mac1Key[:])
+	mac.Write(msg[:116])
+	mac.Sum(msg[116:116])
+
+	// WARP identifies the client by the reserved header bytes, set after the MACs like the bind does.
+	copy(msg[1:4], i.reserved)
+	return msg, sender, nil
+}
+
+func mixHash(h [blake2s.Size]byte, data []byte) [blake2s.Size]byte {
+	return blake2s.Sum256(append(h[:], data...))
+}
+
+func newHMAC(key []byte) hash.Hash {
+	return hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+}
+
+func hmacSum(key []byte, data ...[]byte) (sum [blake2s.Size]byte) {
+	mac := newHMAC(key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	mac.Sum(sum[:0])
+	return
+}
+
+func kdf1(key, input []byte) [blake2s.Size]byte {
+	t0 := hmacSum(key, input)
+	return hmacSum(t0[:], []byte{0x1})
+}
+
+func kdf2(key, input []byte) (t1, t2 [blake2s.Size]byte) {
+	t0 := hmacSum(key, input)
+	t1 = hmacSum(t0[:], []byte{0x1})
+	t2 = hmacSum(t0[:], t1[:], []byte{0x2})
+	return
+}
+
+func seal(key [32]byte, plaintext, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, ad)
+}
+
+func tai64n(t time.Time) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[:8], uint64(0x400000000000000a)+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond()))
+	return buf
+}